@@ -0,0 +1,72 @@
+package dockeripv6nat
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// All supported firewall backends
+const (
+	BackendAuto      = "auto"
+	BackendIP6Tables = "ip6tables"
+	BackendNFTables  = "nftables"
+)
+
+// Backend performs the actual chain and rule changes for the Firewall
+type Backend interface {
+	// EnsureChain creates the given chain if it doesn't exist yet, optionally clearing it
+	EnsureChain(tc TableChain, clear bool) error
+	// RemoveChain clears and deletes the given chain
+	RemoveChain(tc TableChain) error
+	// List returns the rules in the given chain, in order
+	List(tc TableChain) ([]*Rule, error)
+	// Exists checks if the given rule exists
+	Exists(r *Rule) (bool, error)
+	// Insert adds the given rule at the given (1-based) position of its chain
+	Insert(r *Rule, position int) error
+	// Delete removes the given rule from its chain
+	Delete(r *Rule) error
+	// Apply performs all changes of the Transaction, leaving the firewall untouched if any of them fails
+	Apply(tx Transaction) error
+}
+
+// RuleCounters holds the packet and byte counters of a rule
+type RuleCounters struct {
+	Rule    *Rule
+	Packets uint64
+	Bytes   uint64
+}
+
+// CountingBackend is a Backend that can also report the packet and byte counters of its rules
+type CountingBackend interface {
+	Backend
+	// ListCounters returns the rules in the given chain along with their counters, in order
+	ListCounters(tc TableChain) ([]RuleCounters, error)
+}
+
+// ResolveBackend validates the given backend, resolving "auto" to nftables if there is no ip6tables binary
+func ResolveBackend(backend string) (string, error) {
+	switch backend {
+	case BackendIP6Tables, BackendNFTables:
+		return backend, nil
+	case BackendAuto:
+		if _, err := exec.LookPath("ip6tables"); err != nil {
+			return BackendNFTables, nil
+		}
+		return BackendIP6Tables, nil
+	}
+
+	return "", fmt.Errorf("unknown firewall backend: %s", backend)
+}
+
+// NewBackend constructs the Backend with the given (resolved) name, using the given (resolved) xtables mode
+func NewBackend(backend, xtablesMode string) (Backend, error) {
+	switch backend {
+	case BackendIP6Tables:
+		return NewIP6TablesBackend(xtablesMode)
+	case BackendNFTables:
+		return NewNFTablesBackend()
+	}
+
+	return nil, fmt.Errorf("unknown firewall backend: %s", backend)
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/robbertkl/docker-ipv6nat"
@@ -13,11 +15,27 @@ import (
 const buildVersion = "0.4.4"
 
 var (
-	cleanup       bool
-	retry         bool
-	userlandProxy bool
-	version       bool
-	debug         bool
+	backend           string
+	cleanup           bool
+	connLimit         int
+	dryRun            bool
+	dryRunFile        string
+	excludePrefixes   string
+	healthAware       bool
+	includePrefixes   string
+	ipSetFile         string
+	limitPrefixLength int
+	optIn             bool
+	rateLimit         string
+	serveMetrics      bool
+	reconcileInterval time.Duration
+	retry             bool
+	routedPrefixes    string
+	statusListen      string
+	userlandProxy     bool
+	version           bool
+	debug             bool
+	xtablesMode       string
 )
 
 func usage() {
@@ -39,10 +57,26 @@ Environment Variables:
 }
 
 func initFlags() {
+	flag.StringVar(&backend, "backend", dockeripv6nat.BackendAuto, "firewall backend: ip6tables, nftables or auto (nftables if no ip6tables binary is found)")
 	flag.BoolVar(&cleanup, "cleanup", false, "remove rules when shutting down")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", time.Minute, "interval to check for (and repair) changes to the managed rules by others, 0 to disable")
 	flag.BoolVar(&retry, "retry", false, "keep retrying to reconnect after a disconnect")
+	flag.StringVar(&statusListen, "status-listen", "", "serve the JSON status API on this address (host:port or unix:/path/to/socket)")
+	flag.StringVar(&includePrefixes, "include-prefixes", "fc00::/7", "comma-separated IPv6 prefixes of the subnets to manage")
+	flag.StringVar(&excludePrefixes, "exclude-prefixes", "", "comma-separated IPv6 prefixes of the subnets not to manage (overrides -include-prefixes)")
+	flag.StringVar(&routedPrefixes, "routed-prefixes", "", "comma-separated IPv6 prefixes of the subnets to manage in routed mode (only published ports are accepted, without NAT)")
+	flag.StringVar(&ipSetFile, "ipset-file", "", "JSON file with sets of IPv6 prefixes to manage as ipsets, reloaded on SIGHUP")
+	flag.StringVar(&rateLimit, "rate-limit", "", "default limit of new connections to a published port per source prefix, e.g. 50/second or 50/second:100 (with a burst of 100)")
+	flag.IntVar(&connLimit, "conn-limit", 0, "default limit of concurrent connections to a published port per source prefix, 0 for no limit")
+	flag.IntVar(&limitPrefixLength, "limit-prefix-length", 64, "length of the source prefixes to apply -rate-limit and -conn-limit to")
+	flag.BoolVar(&healthAware, "health-aware", false, "only publish containers with a healthcheck while they are healthy")
+	flag.BoolVar(&optIn, "opt-in", false, "only publish containers labelled with ipv6nat.enable=true")
+	flag.BoolVar(&serveMetrics, "metrics", false, "serve Prometheus metrics on /metrics of the -status-listen address")
 	flag.BoolVar(&version, "version", false, "show version")
 	flag.BoolVar(&debug, "debug", false, "log ruleset changes to stdout")
+	flag.BoolVar(&dryRun, "dry-run", false, "only log the ip6tables commands instead of running them")
+	flag.StringVar(&dryRunFile, "dry-run-file", "", "write the -dry-run commands to this file instead of the log")
+	flag.StringVar(&xtablesMode, "xtables-mode", dockeripv6nat.XtablesAuto, "ip6tables variant to use: legacy, nft or auto (same as the docker daemon)")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -71,16 +105,110 @@ func run() error {
 		log.Println("docker-ipv6nat is running in debug mode")
 	}
 
+	if dryRun {
+		log.Println("docker-ipv6nat is running in dry-run mode, the firewall will not be changed")
+	}
+
 	client, err := docker.NewClientFromEnv()
 	if err != nil {
 		return err
 	}
 
-	state, err := dockeripv6nat.NewState(debug)
+	backendName, err := dockeripv6nat.ResolveBackend(backend)
+	if err != nil {
+		return err
+	}
+
+	xtablesModeName, err := dockeripv6nat.ResolveXtablesMode(xtablesMode)
+	if err != nil {
+		return err
+	}
+
+	subnetFilter, err := dockeripv6nat.NewSubnetFilter(includePrefixes, excludePrefixes, routedPrefixes)
+	if err != nil {
+		return err
+	}
+
+	if debug {
+		log.Println("using firewall backend", backendName, "with xtables mode", xtablesModeName)
+	}
+
+	// The limits rely on ip6tables match extensions, so they're not available with the nftables backend.
+	var limits *dockeripv6nat.PortLimits
+	if backendName == dockeripv6nat.BackendNFTables {
+		if rateLimit != "" || connLimit != 0 {
+			return errors.New("-rate-limit and -conn-limit require the ip6tables backend")
+		}
+	} else {
+		limits, err = dockeripv6nat.NewPortLimits(rateLimit, connLimit, limitPrefixLength)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ipSetConfig *dockeripv6nat.IPSetConfig
+	if ipSetFile != "" {
+		if backendName == dockeripv6nat.BackendNFTables {
+			return errors.New("-ipset-file requires the ip6tables backend")
+		}
+		ipSetConfig, err = dockeripv6nat.LoadIPSetConfig(ipSetFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var fwBackend dockeripv6nat.Backend
+	var conntrack dockeripv6nat.Conntrack
+	var ipsets dockeripv6nat.IPSets
+	if dryRun {
+		logger := log.New(os.Stderr, "", log.LstdFlags)
+		if dryRunFile != "" {
+			file, err := os.Create(dryRunFile)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			logger = log.New(file, "", 0)
+		}
+		fwBackend = dockeripv6nat.NewDryRunBackend(logger)
+		conntrack = dockeripv6nat.NewDryRunConntrack(logger)
+		ipsets = dockeripv6nat.NewDryRunIPSets(logger)
+	} else {
+		fwBackend, err = dockeripv6nat.NewBackend(backendName, xtablesModeName)
+		if err != nil {
+			return err
+		}
+		conntrack = dockeripv6nat.NewNetlinkConntrack()
+		ipsets = dockeripv6nat.NewNetlinkIPSets()
+	}
+
+	var metrics *dockeripv6nat.Metrics
+	if serveMetrics {
+		if statusListen == "" {
+			return errors.New("-metrics requires -status-listen")
+		}
+		metrics = dockeripv6nat.NewMetrics()
+		fwBackend = dockeripv6nat.NewMetricsBackend(fwBackend, metrics)
+	}
+
+	hairpinMode, err := dockeripv6nat.DetectHairpinMode(backendName, xtablesModeName)
+	if err != nil {
+		return err
+	}
+
+	manager, err := dockeripv6nat.NewManager(fwBackend, conntrack, ipsets, hairpinMode, debug)
 	if err != nil {
 		return err
 	}
 
+	state := dockeripv6nat.NewState(manager, subnetFilter, optIn, healthAware, limits)
+
+	if ipSetConfig != nil {
+		if err := state.UpdateIPSets(ipSetConfig); err != nil {
+			return err
+		}
+	}
+
 	if cleanup {
 		defer func() {
 			if err := state.Cleanup(); err != nil {
@@ -89,7 +217,21 @@ func run() error {
 		}()
 	}
 
-	watcher := dockeripv6nat.NewWatcher(client, state, retry)
+	if statusListen != "" {
+		server, err := dockeripv6nat.NewStatusServer(state, metrics, statusListen)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+
+		go func() {
+			if err := server.Serve(); err != nil {
+				log.Printf("status API: %v", err)
+			}
+		}()
+	}
+
+	watcher := dockeripv6nat.NewWatcher(client, state, retry, reconcileInterval, ipSetFile, metrics)
 	if err := watcher.Watch(); err != nil {
 		return err
 	}
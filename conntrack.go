@@ -0,0 +1,123 @@
+package dockeripv6nat
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Conntrack deletes conntrack entries, so traffic is no longer steered to removed port mappings or containers
+type Conntrack interface {
+	// DeletePort deletes the entries for traffic to the given host port (on any host address if it's unspecified) that
+	// was translated to the given container address and port
+	DeletePort(proto string, hostAddress net.IP, hostPort uint16, address net.IP, port uint16) error
+	// DeleteAddress deletes the entries for traffic to or from the given (container) address
+	DeleteAddress(address net.IP) error
+}
+
+// NetlinkConntrack is the Conntrack deleting the entries from the kernel, over netlink
+type NetlinkConntrack struct{}
+
+// NewNetlinkConntrack constructs a new NetlinkConntrack
+func NewNetlinkConntrack() *NetlinkConntrack {
+	return &NetlinkConntrack{}
+}
+
+// DeletePort deletes the entries for traffic to the given host port (on any host address if it's unspecified) that
+// was translated to the given container address and port
+func (c *NetlinkConntrack) DeletePort(proto string, hostAddress net.IP, hostPort uint16, address net.IP, port uint16) error {
+	protoNumber, exists := nftProtocols[proto]
+	if !exists {
+		return nil
+	}
+
+	filter := &conntrackPortFilter{
+		proto:       protoNumber,
+		hostAddress: hostAddress,
+		hostPort:    hostPort,
+		address:     address,
+		port:        port,
+	}
+
+	_, err := netlink.ConntrackDeleteFilters(netlink.ConntrackTable, netlink.FAMILY_V6, filter)
+	return err
+}
+
+// conntrackPortFilter matches the flows of a single port mapping. Besides the host port, it matches the reply source
+// (the container address and port), so other flows to the same port (e.g. outbound from the host) are left alone.
+type conntrackPortFilter struct {
+	proto       uint8
+	hostAddress net.IP
+	hostPort    uint16
+	address     net.IP
+	port        uint16
+}
+
+// MatchConntrackFlow applies the filter to the flow and returns true if the flow matches
+func (f *conntrackPortFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	if flow.Forward.Protocol != f.proto || flow.Forward.DstPort != f.hostPort {
+		return false
+	}
+
+	if !f.hostAddress.IsUnspecified() && !flow.Forward.DstIP.Equal(f.hostAddress) {
+		return false
+	}
+
+	return flow.Reverse.SrcIP.Equal(f.address) && flow.Reverse.SrcPort == f.port
+}
+
+// DeleteAddress deletes the entries for traffic to or from the given (container) address
+func (c *NetlinkConntrack) DeleteAddress(address net.IP) error {
+	// Match on the original destination (direct traffic) as well as the reply source (DNAT traffic).
+	origFilter := &netlink.ConntrackFilter{}
+	if err := origFilter.AddIP(netlink.ConntrackOrigDstIP, address); err != nil {
+		return err
+	}
+
+	replyFilter := &netlink.ConntrackFilter{}
+	if err := replyFilter.AddIP(netlink.ConntrackReplySrcIP, address); err != nil {
+		return err
+	}
+
+	_, err := netlink.ConntrackDeleteFilters(netlink.ConntrackTable, netlink.FAMILY_V6, origFilter, replyFilter)
+	return err
+}
+
+// DryRunConntrack is the Conntrack that only logs the conntrack commands it would run
+type DryRunConntrack struct {
+	logger *log.Logger
+}
+
+// NewDryRunConntrack constructs a new DryRunConntrack, logging the commands to the given Logger
+func NewDryRunConntrack(logger *log.Logger) *DryRunConntrack {
+	return &DryRunConntrack{
+		logger: logger,
+	}
+}
+
+func (c *DryRunConntrack) log(args ...string) {
+	c.logger.Println("conntrack -D -f ipv6", strings.Join(args, " "))
+}
+
+// DeletePort deletes the entries for traffic to the given host port (on any host address if it's unspecified) that
+// was translated to the given container address and port
+func (c *DryRunConntrack) DeletePort(proto string, hostAddress net.IP, hostPort uint16, address net.IP, port uint16) error {
+	args := []string{"-p", proto, "--orig-port-dst", strconv.Itoa(int(hostPort))}
+	if !hostAddress.IsUnspecified() {
+		args = append(args, "--orig-dst", hostAddress.String())
+	}
+	args = append(args, "--reply-src", address.String(), "--reply-port-src", strconv.Itoa(int(port)))
+
+	c.log(args...)
+	return nil
+}
+
+// DeleteAddress deletes the entries for traffic to or from the given (container) address
+func (c *DryRunConntrack) DeleteAddress(address net.IP) error {
+	c.log("--orig-dst", address.String())
+	c.log("--reply-src", address.String())
+	return nil
+}
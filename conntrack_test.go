@@ -0,0 +1,51 @@
+package dockeripv6nat
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestConntrackPortFilter(t *testing.T) {
+	filter := &conntrackPortFilter{
+		proto:       6,
+		hostAddress: net.ParseIP("::"),
+		hostPort:    443,
+		address:     net.ParseIP("fd00:1::2"),
+		port:        8443,
+	}
+
+	flow := func(dst string, dstPort uint16, replySrc string, replySrcPort uint16) *netlink.ConntrackFlow {
+		return &netlink.ConntrackFlow{
+			Forward: netlink.IPTuple{Protocol: 6, SrcIP: net.ParseIP("2001:db8::1"), SrcPort: 50000, DstIP: net.ParseIP(dst), DstPort: dstPort},
+			Reverse: netlink.IPTuple{Protocol: 6, SrcIP: net.ParseIP(replySrc), SrcPort: replySrcPort, DstIP: net.ParseIP("2001:db8::1"), DstPort: 50000},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		flow    *netlink.ConntrackFlow
+		matches bool
+	}{
+		{"translated", flow("2001:db8::80", 443, "fd00:1::2", 8443), true},
+		{"outbound", flow("2001:db8::443", 443, "2001:db8::443", 443), false},
+		{"other container", flow("2001:db8::80", 443, "fd00:1::3", 8443), false},
+		{"other container port", flow("2001:db8::80", 443, "fd00:1::2", 443), false},
+		{"other host port", flow("2001:db8::80", 8443, "fd00:1::2", 8443), false},
+	}
+
+	for _, test := range tests {
+		if matches := filter.MatchConntrackFlow(test.flow); matches != test.matches {
+			t.Errorf("%s: expected match %v, got %v", test.name, test.matches, matches)
+		}
+	}
+
+	filter.hostAddress = net.ParseIP("2001:db8::80")
+	if !filter.MatchConntrackFlow(flow("2001:db8::80", 443, "fd00:1::2", 8443)) {
+		t.Error("expected a match on the host address")
+	}
+	if filter.MatchConntrackFlow(flow("2001:db8::81", 443, "fd00:1::2", 8443)) {
+		t.Error("expected no match on another host address")
+	}
+}
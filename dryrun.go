@@ -0,0 +1,85 @@
+package dockeripv6nat
+
+import (
+	"log"
+	"strings"
+)
+
+// DryRunBackend is a Backend that only logs the ip6tables commands it would run, keeping track of the rules in memory.
+// Since it starts out without any rules, it shows the commands needed on a host without any docker-ipv6nat rules yet.
+type DryRunBackend struct {
+	memory *MemoryBackend
+	logger *log.Logger
+}
+
+// NewDryRunBackend constructs a new DryRunBackend, logging the commands to the given Logger
+func NewDryRunBackend(logger *log.Logger) *DryRunBackend {
+	return &DryRunBackend{
+		memory: NewMemoryBackend(),
+		logger: logger,
+	}
+}
+
+func (b *DryRunBackend) log(table Table, args ...string) {
+	b.logger.Println("ip6tables -t", string(table), strings.Join(args, " "))
+}
+
+// EnsureChain creates the given chain if it doesn't exist yet, optionally clearing it
+func (b *DryRunBackend) EnsureChain(tc TableChain, clear bool) error {
+	if _, exists := b.memory.chains[tc]; !exists {
+		b.log(tc.table, "-N", string(tc.chain))
+	} else if clear {
+		b.log(tc.table, "-F", string(tc.chain))
+	}
+
+	return b.memory.EnsureChain(tc, clear)
+}
+
+// RemoveChain clears and deletes the given chain
+func (b *DryRunBackend) RemoveChain(tc TableChain) error {
+	if err := b.memory.RemoveChain(tc); err != nil {
+		return err
+	}
+
+	b.log(tc.table, "-F", string(tc.chain))
+	b.log(tc.table, "-X", string(tc.chain))
+	return nil
+}
+
+// List returns the rules in the given chain, in order
+func (b *DryRunBackend) List(tc TableChain) ([]*Rule, error) {
+	return b.memory.List(tc)
+}
+
+// ListCounters returns the rules in the given chain along with their counters, which are always 0
+func (b *DryRunBackend) ListCounters(tc TableChain) ([]RuleCounters, error) {
+	return b.memory.ListCounters(tc)
+}
+
+// Exists checks if the given rule exists
+func (b *DryRunBackend) Exists(r *Rule) (bool, error) {
+	return b.memory.Exists(r)
+}
+
+// Insert adds the given rule at the given (1-based) position of its chain
+func (b *DryRunBackend) Insert(r *Rule, position int) error {
+	return b.Apply(Transaction{{Rule: r, Position: position}})
+}
+
+// Delete removes the given rule from its chain
+func (b *DryRunBackend) Delete(r *Rule) error {
+	return b.Apply(Transaction{{Rule: r, Delete: true}})
+}
+
+// Apply performs all changes of the Transaction in memory, logging them if they all succeed
+func (b *DryRunBackend) Apply(tx Transaction) error {
+	if err := b.memory.Apply(tx); err != nil {
+		return err
+	}
+
+	for _, change := range tx {
+		b.log(change.Rule.tc.table, changeArgs(change)...)
+	}
+
+	return nil
+}
@@ -1,10 +1,11 @@
 package dockeripv6nat
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
 	"strings"
-
-	"github.com/coreos/go-iptables/iptables"
 )
 
 // Table describes an ip(6)tables table
@@ -30,8 +31,12 @@ const (
 	ChainDocker           = "DOCKER"
 	ChainDockerIsolation1 = "DOCKER-ISOLATION-STAGE-1"
 	ChainDockerIsolation2 = "DOCKER-ISOLATION-STAGE-2"
+	ChainSNAT             = "DOCKER-IPV6NAT-SNAT"
 )
 
+// commentPrefix starts the comment of every rule managed by docker-ipv6nat
+const commentPrefix = "ipv6nat"
+
 // TableChain references a combination of an ip(6)tables table and chain
 type TableChain struct {
 	table Table
@@ -67,6 +72,78 @@ func (r *Rule) hash() string {
 	return strings.Join(r.spec, "#")
 }
 
+// target returns the jump target of the Rule (if any)
+func (r *Rule) target() string {
+	for index := 0; index < len(r.spec)-1; index++ {
+		if r.spec[index] == "-j" {
+			return r.spec[index+1]
+		}
+	}
+
+	return ""
+}
+
+// comment returns the comment of the Rule (if any)
+func (r *Rule) comment() string {
+	for index := 0; index < len(r.spec)-1; index++ {
+		if r.spec[index] == "--comment" {
+			return r.spec[index+1]
+		}
+	}
+
+	return ""
+}
+
+// owner returns the owner from the ownership comment of the Rule (if any)
+func (r *Rule) owner() string {
+	comment := r.comment()
+	if !strings.HasPrefix(comment, commentPrefix+" ") {
+		return ""
+	}
+
+	return comment[len(commentPrefix)+1 : strings.LastIndex(comment, " ")]
+}
+
+// Tag adds an ownership comment to the Rule, which includes a checksum of the Rule itself to identify it
+func (r *Rule) Tag(owner string) *Rule {
+	checksum := fnv.New32a()
+	checksum.Write([]byte(string(r.tc.table) + "#" + string(r.tc.chain) + "#" + r.hash()))
+
+	comment := fmt.Sprintf("%s %s %08x", commentPrefix, owner, checksum.Sum32())
+
+	// Insert the comment before the target, which is also where ip6tables -S lists it
+	index := len(r.spec)
+	for i, arg := range r.spec {
+		if arg == "-j" {
+			index = i
+			break
+		}
+	}
+	spec := append([]string{}, r.spec[:index]...)
+	spec = append(spec, "-m", "comment", "--comment", comment)
+	r.spec = append(spec, r.spec[index:]...)
+	return r
+}
+
+// untagged returns a copy of the Rule without its ownership comment, as it was created by earlier versions
+func (r *Rule) untagged() *Rule {
+	spec := make([]string, 0, len(r.spec))
+	for index := 0; index < len(r.spec); index++ {
+		if index+3 < len(r.spec) && r.spec[index] == "-m" && r.spec[index+1] == "comment" && r.spec[index+2] == "--comment" &&
+			strings.HasPrefix(r.spec[index+3], commentPrefix+" ") {
+			index += 3
+			continue
+		}
+		spec = append(spec, r.spec[index])
+	}
+
+	return &Rule{
+		tc:      r.tc,
+		spec:    spec,
+		prepend: r.prepend,
+	}
+}
+
 // Equal compares 2 Rules
 func (r *Rule) Equal(other *Rule) bool {
 	if r.tc != other.tc {
@@ -100,6 +177,15 @@ func (s *Ruleset) Contains(r *Rule) bool {
 	return false
 }
 
+// Tag adds an ownership comment to all Rules in the Ruleset
+func (s *Ruleset) Tag(owner string) *Ruleset {
+	for _, r := range *s {
+		r.Tag(owner)
+	}
+
+	return s
+}
+
 // Diff returns a new Ruleset with only the rules that are not part of other
 func (s *Ruleset) Diff(other *Ruleset) *Ruleset {
 	if len(*other) == 0 {
@@ -116,27 +202,70 @@ func (s *Ruleset) Diff(other *Ruleset) *Ruleset {
 	return &diffed
 }
 
+// RuleChange describes the insertion or deletion of a single Rule.
+// For deletions, Position is where the Rule would be reinserted when rolling back.
+type RuleChange struct {
+	Rule     *Rule
+	Delete   bool
+	Position int
+}
+
+// Inverse returns the RuleChange undoing this RuleChange
+func (c *RuleChange) Inverse() *RuleChange {
+	return &RuleChange{
+		Rule:     c.Rule,
+		Delete:   !c.Delete,
+		Position: c.Position,
+	}
+}
+
+// Transaction is an ordered list of RuleChanges, which should be applied all-or-nothing
+type Transaction []*RuleChange
+
+// Inverse returns the Transaction undoing this Transaction
+func (tx Transaction) Inverse() Transaction {
+	inverse := make(Transaction, len(tx))
+	for index, change := range tx {
+		inverse[len(tx)-1-index] = change.Inverse()
+	}
+
+	return inverse
+}
+
+// ownerChain identifies the rules of a single owner within a chain, which are kept in the order of its Ruleset
+type ownerChain struct {
+	owner string
+	tc    TableChain
+}
+
 // Firewall keeps track of the active rules, in order to perform proper appends/prepends
 type Firewall struct {
-	ipt               *iptables.IPTables
+	backend           Backend
 	activeRules       map[TableChain]map[string]bool
+	ownChains         map[TableChain]bool
+	adoptedChains     map[TableChain]bool
+	untaggedRemoved   bool
 	debug             bool
 	userChainJumpRule *Rule
-}
+	snatChainJumpRule *Rule
 
-// NewFirewall constructs a new Firewall
-func NewFirewall(debug bool) (*Firewall, error) {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
-	if err != nil {
-		return nil, err
-	}
+	// userChainReturnRule is kept at the bottom of DOCKER-USER, below any custom rules, so it's never reconciled
+	userChainReturnRule *Rule
+}
 
+// NewFirewall constructs a new Firewall on top of the given Backend
+func NewFirewall(backend Backend, debug bool) *Firewall {
 	return &Firewall{
-		ipt:               ipt,
+		backend:           backend,
 		activeRules:       make(map[TableChain]map[string]bool),
+		ownChains:         make(map[TableChain]bool),
+		adoptedChains:     make(map[TableChain]bool),
 		debug:             debug,
-		userChainJumpRule: NewRule(TableFilter, ChainForward, "-j", ChainDockerUser),
-	}, nil
+		userChainJumpRule: NewRule(TableFilter, ChainForward, "-j", ChainDockerUser).Tag(baseOwner),
+		snatChainJumpRule: NewRule(TableNat, ChainPostrouting, "-j", ChainSNAT).Tag(baseOwner),
+
+		userChainReturnRule: NewRule(TableFilter, ChainDockerUser, "-j", "RETURN").Tag(baseOwner),
+	}
 }
 
 func (fw *Firewall) activateRule(r *Rule) {
@@ -150,13 +279,147 @@ func (fw *Firewall) deactivateRule(r *Rule) {
 	delete(fw.activeRules[r.tc], r.hash())
 }
 
-// EnsureTableChains creates (and clears!) the given TableChains
+func (fw *Firewall) isActive(r *Rule) bool {
+	return fw.activeRules[r.tc][r.hash()]
+}
+
+// pinnedRule returns the jump that's kept at the very top of the given chain (above our prepended rules), if any
+func (fw *Firewall) pinnedRule(tc TableChain) *Rule {
+	for _, rule := range []*Rule{fw.userChainJumpRule, fw.snatChainJumpRule} {
+		if rule.tc == tc {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// prependPosition returns the position to prepend a rule at: the top of its chain, but below the pinned jump (if any)
+func (fw *Firewall) prependPosition(r *Rule) int {
+	if pinned := fw.pinnedRule(r.tc); pinned != nil && !r.Equal(pinned) && fw.isActive(pinned) {
+		return 2
+	}
+
+	return 1
+}
+
+// exists checks if a Rule exists, only querying the backend if it's not in one of our own (reconciled) chains.
+// Tagged rules are identified by their comment, listing each chain only once (caching the result in listed).
+func (fw *Firewall) exists(r *Rule, listed map[TableChain]map[string]bool) (bool, error) {
+	if fw.isActive(r) {
+		return true, nil
+	}
+
+	if fw.ownChains[r.tc] {
+		return false, nil
+	}
+
+	comment := r.comment()
+	if comment == "" {
+		return fw.backend.Exists(r)
+	}
+
+	comments, loaded := listed[r.tc]
+	if !loaded {
+		rules, err := fw.backend.List(r.tc)
+		if err != nil {
+			return false, err
+		}
+
+		comments = make(map[string]bool, len(rules))
+		for _, rule := range rules {
+			if c := rule.comment(); c != "" {
+				comments[c] = true
+			}
+		}
+		listed[r.tc] = comments
+	}
+
+	return comments[comment], nil
+}
+
+// listRule updates the cached listing of the chain of a Rule (if any) after it has been queued for adding or deleting
+func listRule(r *Rule, listed map[TableChain]map[string]bool, exists bool) {
+	comment := r.comment()
+	if comment == "" || listed[r.tc] == nil {
+		return
+	}
+
+	if exists {
+		listed[r.tc][comment] = true
+	} else {
+		delete(listed[r.tc], comment)
+	}
+}
+
+// firstOccurrence records the Rule in seen, returning false if it has been seen before (e.g. a container publishing a
+// port on 2 host ports has identical filter rules for both)
+func firstOccurrence(r *Rule, seen map[TableChain]map[string]bool) bool {
+	if seen[r.tc] == nil {
+		seen[r.tc] = make(map[string]bool)
+	}
+
+	if seen[r.tc][r.hash()] {
+		return false
+	}
+
+	seen[r.tc][r.hash()] = true
+	return true
+}
+
+// Counters returns the counters of our (tagged) rules in the given TableChain, by comment
+func (fw *Firewall) Counters(tc TableChain) (map[string]RuleCounters, error) {
+	backend, ok := fw.backend.(CountingBackend)
+	if !ok {
+		return nil, errors.New("firewall backend does not support counters")
+	}
+
+	counters, err := backend.ListCounters(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	byComment := make(map[string]RuleCounters, len(counters))
+	for _, counter := range counters {
+		if comment := counter.Rule.comment(); comment != "" {
+			byComment[comment] = counter
+		}
+	}
+
+	return byComment, nil
+}
+
+// EnsureTableChains creates the given TableChains if needed, without clearing them.
+// Any existing rules are adopted: ours are identified by their comment until the next Reconcile, which removes the
+// rules we no longer expect (e.g. from containers removed while we were not running). Untagged rules can't be
+// identified, so they're removed right away (e.g. the rules of an earlier version, which cleared the chains instead).
 func (fw *Firewall) EnsureTableChains(tableChains []TableChain) error {
 	for _, tc := range tableChains {
-		if err := fw.ipt.ClearChain(string(tc.table), string(tc.chain)); err != nil {
+		if err := fw.backend.EnsureChain(tc, false); err != nil {
 			return err
 		}
 		delete(fw.activeRules, tc)
+		delete(fw.ownChains, tc)
+		fw.adoptedChains[tc] = true
+
+		rules, err := fw.backend.List(tc)
+		if err != nil {
+			return err
+		}
+
+		tx := make(Transaction, 0)
+		for index, rule := range rules {
+			if !strings.HasPrefix(rule.comment(), commentPrefix+" ") {
+				tx = append(tx, &RuleChange{Rule: rule, Delete: true, Position: index + 1 - len(tx)})
+			}
+		}
+
+		if len(tx) > 0 {
+			if err := fw.backend.Apply(tx); err != nil {
+				return err
+			}
+			log.Printf("removed %d untagged rules from chain %s (table %s)", len(tx), tc.chain, tc.table)
+		}
 	}
 
 	return nil
@@ -165,29 +428,403 @@ func (fw *Firewall) EnsureTableChains(tableChains []TableChain) error {
 // RemoveTableChains deletes the given TableChains
 func (fw *Firewall) RemoveTableChains(tableChains []TableChain) error {
 	for _, tc := range tableChains {
-		fw.ipt.ClearChain(string(tc.table), string(tc.chain))
-		fw.ipt.DeleteChain(string(tc.table), string(tc.chain))
+		fw.backend.RemoveChain(tc)
 		delete(fw.activeRules, tc)
+		delete(fw.ownChains, tc)
+		delete(fw.adoptedChains, tc)
 	}
 
 	return nil
 }
 
+// ApplyRules ensures the Rules in the first Ruleset and removes the Rules in the second, in a single Transaction
+func (fw *Firewall) ApplyRules(ensureRules, removeRules *Ruleset) error {
+	tx := make(Transaction, 0, len(*ensureRules)+len(*removeRules))
+	activate := make([]*Rule, 0, len(*ensureRules))
+	listed := make(map[TableChain]map[string]bool)
+	counts := make(map[TableChain]int)
+	for tc, rules := range fw.activeRules {
+		counts[tc] = len(rules)
+	}
+
+	// A regular loop to append only the non-prepend rules, followed by a reverse loop for the prepend rules.
+	// The rules of an owner are kept in the order of the Ruleset: once one is inserted, the existing rules of the same
+	// owner that should follow it are moved along (deleted and inserted again).
+	ensured := make(map[TableChain]map[string]bool)
+	for _, prepend := range []bool{false, true} {
+		moving := make(map[ownerChain]bool)
+		for index := range *ensureRules {
+			rule := (*ensureRules)[index]
+			if prepend {
+				rule = (*ensureRules)[len(*ensureRules)-1-index]
+			}
+			if rule.prepend != prepend || !firstOccurrence(rule, ensured) {
+				continue
+			}
+
+			exists, err := fw.exists(rule, listed)
+			if err != nil {
+				return err
+			}
+
+			key := ownerChain{rule.owner(), rule.tc}
+			if exists && moving[key] {
+				position := counts[rule.tc]
+				if rule.prepend {
+					position = fw.prependPosition(rule)
+				}
+				tx = append(tx, &RuleChange{Rule: rule, Delete: true, Position: position})
+				counts[rule.tc]--
+				exists = false
+			}
+
+			if !exists {
+				position := counts[rule.tc] + 1
+				if rule.prepend {
+					position = fw.prependPosition(rule)
+				}
+				tx = append(tx, &RuleChange{Rule: rule, Position: position})
+				counts[rule.tc]++
+				listRule(rule, listed, true)
+				moving[key] = true
+			}
+			activate = append(activate, rule)
+		}
+	}
+
+	deactivate := make([]*Rule, 0, len(*removeRules))
+	removed := make(map[TableChain]map[string]bool)
+	for _, rule := range *removeRules {
+		if rule.Equal(fw.userChainJumpRule) || !firstOccurrence(rule, removed) {
+			continue
+		}
+
+		exists, err := fw.exists(rule, listed)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			position := counts[rule.tc]
+			if rule.prepend {
+				position = fw.prependPosition(rule)
+			}
+			tx = append(tx, &RuleChange{Rule: rule, Delete: true, Position: position})
+			counts[rule.tc]--
+			listRule(rule, listed, false)
+		}
+		deactivate = append(deactivate, rule)
+	}
+
+	if len(tx) > 0 {
+		if err := fw.backend.Apply(tx); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range activate {
+		fw.activateRule(rule)
+	}
+	for _, rule := range deactivate {
+		fw.deactivateRule(rule)
+	}
+
+	if fw.debug {
+		for _, change := range tx {
+			if change.Delete {
+				log.Println("rule removed: -t", string(change.Rule.tc.table), "-D", string(change.Rule.tc.chain), strings.Join(change.Rule.spec, " "))
+			} else {
+				log.Println("rule added: -t", string(change.Rule.tc.table), "-I", string(change.Rule.tc.chain), change.Position, strings.Join(change.Rule.spec, " "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reconcile compares the complete Ruleset we expect with the live firewall and repairs any drift in a single
+// Transaction. Our rules are expected at the top of each chain (prepended rules first, the pinned jumps to DOCKER-USER
+// and DOCKER-IPV6NAT-SNAT first of all), so missing rules are reinstalled there, misplaced rules are moved back and any
+// other rules carrying our ownership comment are removed. Only tagged rules can be identified and are reconciled. It
+// returns the number of drifted rules.
+// The rules of each owner are also expected in the order of the Ruleset, so rules out of order are misplaced as well.
+// Adopted chains are always reconciled (even without expected rules) and become our own chains afterwards.
+// The first Reconcile also removes the untagged copies of the expected rules in the builtin chains, as created by
+// earlier versions (the other chains are cleaned up by EnsureTableChains already).
+func (fw *Firewall) Reconcile(expected *Ruleset) (int, error) {
+	tableChains := make([]TableChain, 0)
+	expectedRules := make(map[TableChain][]*Rule)
+	for tc := range fw.adoptedChains {
+		tableChains = append(tableChains, tc)
+		expectedRules[tc] = nil
+	}
+	for _, rule := range *expected {
+		if rule.comment() == "" {
+			continue
+		}
+		if _, exists := expectedRules[rule.tc]; !exists {
+			tableChains = append(tableChains, rule.tc)
+		}
+		expectedRules[rule.tc] = append(expectedRules[rule.tc], rule)
+	}
+
+	tx := make(Transaction, 0)
+	drifted := 0
+	for _, tc := range tableChains {
+		removeUntagged := !fw.untaggedRemoved && !fw.ownChains[tc] && !fw.adoptedChains[tc] && tc.chain != ChainDockerUser
+		changes, count, err := fw.reconcileChain(tc, expectedRules[tc], removeUntagged)
+		if err != nil {
+			return 0, err
+		}
+		tx = append(tx, changes...)
+		drifted += count
+	}
+
+	if len(tx) > 0 {
+		if err := fw.backend.Apply(tx); err != nil {
+			return drifted, err
+		}
+	}
+
+	for tc := range fw.adoptedChains {
+		fw.ownChains[tc] = true
+		delete(fw.adoptedChains, tc)
+	}
+	fw.untaggedRemoved = true
+
+	// Deleting a duplicate also deactivates the copy that's kept, so (re)activate every expected rule afterwards.
+	for _, change := range tx {
+		if change.Delete {
+			fw.deactivateRule(change.Rule)
+		}
+	}
+	for _, rules := range expectedRules {
+		for _, rule := range rules {
+			fw.activateRule(rule)
+		}
+	}
+
+	if fw.debug {
+		for _, change := range tx {
+			if change.Delete {
+				log.Println("rule removed: -t", string(change.Rule.tc.table), "-D", string(change.Rule.tc.chain), strings.Join(change.Rule.spec, " "))
+			} else {
+				log.Println("rule added: -t", string(change.Rule.tc.table), "-I", string(change.Rule.tc.chain), change.Position, strings.Join(change.Rule.spec, " "))
+			}
+		}
+	}
+
+	return drifted, nil
+}
+
+// reconcileChain returns the changes needed to bring a single chain back to the expected rules (in order), removing
+// their untagged copies as well if requested
+func (fw *Firewall) reconcileChain(tc TableChain, rules []*Rule, removeUntagged bool) (Transaction, int, error) {
+	if err := fw.backend.EnsureChain(tc, false); err != nil {
+		return nil, 0, err
+	}
+
+	live, err := fw.backend.List(tc)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	expected := make(map[string]*Rule, len(rules))
+	order := make(map[string]int, len(rules))
+	for index, rule := range rules {
+		expected[rule.comment()] = rule
+		if _, exists := order[rule.comment()]; !exists {
+			order[rule.comment()] = index
+		}
+	}
+
+	var untagged []*Rule
+	if removeUntagged {
+		for _, rule := range rules {
+			untagged = append(untagged, rule.untagged())
+		}
+	}
+	isUntagged := func(rule *Rule) bool {
+		for _, other := range untagged {
+			if rule.Equal(other) {
+				return true
+			}
+		}
+		return false
+	}
+
+	pinned := fw.pinnedRule(tc)
+	isPinned := func(rule *Rule) bool {
+		return pinned != nil && rule.Equal(pinned)
+	}
+
+	// First find the rules that are unexpected or out of place, without touching anything yet
+	const (
+		ruleForeign = iota
+		ruleKept
+		ruleUnexpected
+		ruleMisplaced
+		ruleUntagged
+	)
+	states := make([]int, len(live))
+	seen := make(map[string]bool, len(rules))
+	count := 0 // number of our rules kept at the top of the chain
+	inBlock := true
+	seenAppend := false
+
+	for index, rule := range live {
+		comment := rule.comment()
+		if isUntagged(rule) {
+			// Removed below, so it doesn't break the block of our rules
+			states[index] = ruleUntagged
+			continue
+		}
+		if !strings.HasPrefix(comment, commentPrefix+" ") || rule.Equal(fw.userChainReturnRule) {
+			inBlock = false
+			continue
+		}
+		duplicate := seen[comment]
+		seen[comment] = true
+
+		expectedRule, isExpected := expected[comment]
+		switch {
+		case !isExpected || duplicate:
+			states[index] = ruleUnexpected
+		case !inBlock || (expectedRule.prepend && seenAppend) || (isPinned(expectedRule) && count > 0):
+			states[index] = ruleMisplaced
+		default:
+			states[index] = ruleKept
+			seenAppend = seenAppend || !expectedRule.prepend
+			count++
+		}
+	}
+
+	// The rules of an owner also need to be in the expected order (e.g. a DROP after the jump to the DOCKER chain), or
+	// they are all moved (appends and prepends separately, since they are inserted separately).
+	type orderKey struct {
+		owner   string
+		prepend bool
+	}
+	last := make(map[orderKey]int)
+	disordered := make(map[orderKey]bool)
+	for index, rule := range live {
+		if states[index] != ruleKept {
+			continue
+		}
+		key := orderKey{rule.owner(), expected[rule.comment()].prepend}
+		if previous, exists := last[key]; exists && order[rule.comment()] < previous {
+			disordered[key] = true
+		}
+		last[key] = order[rule.comment()]
+	}
+
+	tx := make(Transaction, 0)
+	drifted := 0
+	kept := make(map[string]bool, len(rules))
+	keptJump := false
+	count = 0
+	deleted := 0
+	removed := 0
+
+	for index, rule := range live {
+		state := states[index]
+		if state == ruleKept && disordered[orderKey{rule.owner(), expected[rule.comment()].prepend}] {
+			state = ruleMisplaced
+		}
+
+		position := index + 1 - deleted
+		switch state {
+		case ruleForeign:
+			continue
+		case ruleUntagged:
+			tx = append(tx, &RuleChange{Rule: rule, Delete: true, Position: position})
+			deleted++
+			removed++
+			continue
+		case ruleUnexpected:
+			log.Printf("rule drifted (unexpected): -t %s -A %s %s", tc.table, tc.chain, strings.Join(rule.spec, " "))
+			tx = append(tx, &RuleChange{Rule: rule, Delete: true, Position: position})
+		case ruleMisplaced:
+			expectedRule := expected[rule.comment()]
+			log.Printf("rule drifted (misplaced): -t %s -A %s %s", tc.table, tc.chain, strings.Join(expectedRule.spec, " "))
+			tx = append(tx, &RuleChange{Rule: expectedRule, Delete: true, Position: position})
+		default:
+			kept[rule.comment()] = true
+			keptJump = keptJump || isPinned(rule)
+			count++
+			continue
+		}
+
+		deleted++
+		drifted++
+	}
+
+	if removed > 0 {
+		log.Printf("removed %d untagged rules from chain %s (table %s)", removed, tc.chain, tc.table)
+	}
+
+	// Reinstall the missing (and misplaced) rules, the same way ApplyRules would: appends right after our other rules,
+	// prepends in reverse at the top (but below the pinned jump, which is always inserted last).
+	prependPosition := 1
+	if keptJump {
+		prependPosition = 2
+	}
+
+	var jumpRule *Rule
+	for _, prepend := range []bool{false, true} {
+		for index := range rules {
+			rule := rules[index]
+			if prepend {
+				rule = rules[len(rules)-1-index]
+			}
+			if rule.prepend != prepend || kept[rule.comment()] {
+				continue
+			}
+
+			if !seen[rule.comment()] {
+				log.Printf("rule drifted (missing): -t %s -A %s %s", tc.table, tc.chain, strings.Join(rule.spec, " "))
+				drifted++
+			}
+
+			kept[rule.comment()] = true
+			if isPinned(rule) {
+				jumpRule = rule
+				continue
+			}
+
+			position := count + 1
+			if rule.prepend {
+				position = prependPosition
+			}
+			tx = append(tx, &RuleChange{Rule: rule, Position: position})
+			count++
+		}
+	}
+
+	if jumpRule != nil {
+		tx = append(tx, &RuleChange{Rule: jumpRule, Position: 1})
+	}
+
+	return tx, drifted, nil
+}
+
 // EnsureRules makes sure the Rules in the given Ruleset exist or it creates them
 func (fw *Firewall) EnsureRules(rules *Ruleset) error {
+	listed := make(map[TableChain]map[string]bool)
+
 	// A regular loop to append only the non-prepend rules
 	for _, rule := range *rules {
 		if rule.prepend {
 			continue
 		}
 
-		exists, err := fw.ipt.Exists(string(rule.tc.table), string(rule.tc.chain), rule.spec...)
+		exists, err := fw.exists(rule, listed)
 		if err != nil {
 			return err
 		}
 
 		if !exists {
-			if err := fw.ipt.Insert(string(rule.tc.table), string(rule.tc.chain), len(fw.activeRules[rule.tc])+1, rule.spec...); err != nil {
+			if err := fw.backend.Insert(rule, len(fw.activeRules[rule.tc])+1); err != nil {
 				return err
 			}
 			if fw.debug {
@@ -204,17 +841,18 @@ func (fw *Firewall) EnsureRules(rules *Ruleset) error {
 			continue
 		}
 
-		exists, err := fw.ipt.Exists(string(rule.tc.table), string(rule.tc.chain), rule.spec...)
+		exists, err := fw.exists(rule, listed)
 		if err != nil {
 			return err
 		}
 
 		if !exists {
-			if err := fw.ipt.Insert(string(rule.tc.table), string(rule.tc.chain), 1, rule.spec...); err != nil {
+			position := fw.prependPosition(rule)
+			if err := fw.backend.Insert(rule, position); err != nil {
 				return err
 			}
 			if fw.debug {
-				log.Println("rule added: -t", string(rule.tc.table), "-I", string(rule.tc.chain), 1, strings.Join(rule.spec, " "))
+				log.Println("rule added: -t", string(rule.tc.table), "-I", string(rule.tc.chain), position, strings.Join(rule.spec, " "))
 			}
 		}
 		fw.activateRule(rule)
@@ -225,23 +863,26 @@ func (fw *Firewall) EnsureRules(rules *Ruleset) error {
 
 // RemoveRules makes sure the Rules in the given Ruleset don't exist or removes them
 func (fw *Firewall) RemoveRules(rules *Ruleset) error {
+	listed := make(map[TableChain]map[string]bool)
+
 	for _, rule := range *rules {
 		if rule.Equal(fw.userChainJumpRule) {
 			continue
 		}
 
-		exists, err := fw.ipt.Exists(string(rule.tc.table), string(rule.tc.chain), rule.spec...)
+		exists, err := fw.exists(rule, listed)
 		if err != nil {
 			return err
 		}
 
 		if exists {
-			if err := fw.ipt.Delete(string(rule.tc.table), string(rule.tc.chain), rule.spec...); err != nil {
+			if err := fw.backend.Delete(rule); err != nil {
 				return err
 			}
 			if fw.debug {
 				log.Println("rule removed: -t", string(rule.tc.table), "-D", string(rule.tc.chain), strings.Join(rule.spec, " "))
 			}
+			listRule(rule, listed, false)
 		}
 		fw.deactivateRule(rule)
 	}
@@ -251,35 +892,40 @@ func (fw *Firewall) RemoveRules(rules *Ruleset) error {
 
 // EnsureUserFilterChain makes sure the DOCKER-USER chain exists, without clearing it
 func (fw *Firewall) EnsureUserFilterChain() error {
-	chains, err := fw.ipt.ListChains(TableFilter)
-	if err != nil {
+	tc := TableChain{TableFilter, ChainDockerUser}
+	if err := fw.backend.EnsureChain(tc, false); err != nil {
 		return err
 	}
 
-	exists := false
-	for _, chain := range chains {
-		if chain == ChainDockerUser {
-			exists = true
-		}
+	returnRule := fw.userChainReturnRule
+	exists, err := fw.backend.Exists(returnRule)
+	if err != nil {
+		return err
 	}
 
 	if !exists {
-		if err = fw.ipt.NewChain(TableFilter, ChainDockerUser); err != nil {
+		rules, err := fw.backend.List(tc)
+		if err != nil {
+			return err
+		}
+		if err := fw.backend.Insert(returnRule, len(rules)+1); err != nil {
 			return err
 		}
 	}
 
-	if err = fw.ipt.AppendUnique(TableFilter, ChainDockerUser, "-j", "RETURN"); err != nil {
-		return err
-	}
-
-	exists, err = fw.ipt.Exists(TableFilter, ChainForward, "-j", ChainDockerUser)
+	// Remove an untagged jump to DOCKER-USER, so it will be prepended again by the base rules.
+	// Our own (tagged) jump is kept, Reconcile moves it back to the top if needed.
+	jumpRule := NewRule(TableFilter, ChainForward, "-j", ChainDockerUser)
+	exists, err = fw.backend.Exists(jumpRule)
 	if err != nil {
 		return err
 	}
 
 	if exists {
-		err = fw.ipt.Delete(TableFilter, ChainForward, "-j", ChainDockerUser)
+		if err := fw.backend.Delete(jumpRule); err != nil {
+			return err
+		}
 	}
-	return err
+
+	return nil
 }
@@ -0,0 +1,129 @@
+package dockeripv6nat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyRulesSkipsDuplicates(t *testing.T) {
+	b := NewMemoryBackend()
+	fw := NewFirewall(b, false)
+
+	// The same rule can be generated more than once, e.g. for 2 host ports mapped to the same container port.
+	rules := &Ruleset{
+		NewRule(TableFilter, ChainForward, "-o", "br0", "-j", "ACCEPT").Tag("container web c1"),
+		NewPrependRule(TableFilter, ChainForward, "-i", "br0", "-j", "ACCEPT").Tag("container web c1"),
+		NewRule(TableFilter, ChainForward, "-o", "br0", "-j", "ACCEPT").Tag("container web c1"),
+		NewPrependRule(TableFilter, ChainForward, "-i", "br0", "-j", "ACCEPT").Tag("container web c1"),
+	}
+
+	if err := fw.ApplyRules(rules, &Ruleset{}); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-i br0 -j ACCEPT",
+		"-o br0 -j ACCEPT",
+	)
+
+	if err := fw.ApplyRules(&Ruleset{}, rules); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainForward)
+}
+
+func TestRestoreInput(t *testing.T) {
+	tx := Transaction{
+		{Rule: NewRule(TableFilter, ChainDocker, "-m", "comment", "--comment", `ipv6nat "web"`, "-j", "ACCEPT"), Position: 1},
+		{Rule: NewRule(TableNat, ChainDocker, "-j", "RETURN"), Position: 2},
+		{Rule: NewRule(TableFilter, ChainForward, "-j", "DROP"), Delete: true, Position: 3},
+	}
+
+	input, commitLines := restoreInput(tx)
+
+	expected := strings.Join([]string{
+		"*filter",
+		`-I DOCKER 1 -m comment --comment "ipv6nat \"web\"" -j ACCEPT`,
+		"-D FORWARD -j DROP",
+		"COMMIT",
+		"*nat",
+		"-I DOCKER 2 -j RETURN",
+		"COMMIT",
+		"",
+	}, "\n")
+	if string(input) != expected {
+		t.Errorf("unexpected input:\n%s\nexpected:\n%s", input, expected)
+	}
+
+	if expected := map[Table]int{TableFilter: 4, TableNat: 7}; !reflect.DeepEqual(commitLines, expected) {
+		t.Errorf("unexpected commit lines %v, expected %v", commitLines, expected)
+	}
+}
+
+func TestIP6TablesBackendApplyRollback(t *testing.T) {
+	// Fake ip6tables-restore, failing in the nat table after the filter table has been committed
+	dir := t.TempDir()
+	script := fmt.Sprintf(`#!/bin/sh
+if [ -e %[1]s/input ]; then
+	cat > %[1]s/rollback
+	exit 0
+fi
+cat > %[1]s/input
+echo "ip6tables-restore: line 6 failed"
+exit 1
+`, dir)
+	restorePath := filepath.Join(dir, "ip6tables-restore")
+	if err := os.WriteFile(restorePath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &IP6TablesBackend{restorePath: restorePath}
+	tx := Transaction{
+		{Rule: NewRule(TableFilter, ChainDocker, "-o", "br0", "-j", "ACCEPT"), Position: 1},
+		{Rule: NewRule(TableFilter, ChainForward, "-j", "DROP"), Delete: true, Position: 3},
+		{Rule: NewRule(TableNat, ChainDocker, "-j", "RETURN"), Position: 2},
+	}
+	if err := b.Apply(tx); err == nil || !strings.Contains(err.Error(), "line 6 failed") {
+		t.Fatalf("expected the ip6tables-restore error, got %v", err)
+	}
+
+	rollback, err := os.ReadFile(filepath.Join(dir, "rollback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the committed filter table is rolled back, in reverse order
+	expected := strings.Join([]string{
+		"*filter",
+		"-I FORWARD 3 -j DROP",
+		"-D DOCKER -o br0 -j ACCEPT",
+		"COMMIT",
+		"",
+	}, "\n")
+	if string(rollback) != expected {
+		t.Errorf("unexpected rollback:\n%s\nexpected:\n%s", rollback, expected)
+	}
+}
+
+// assertChain checks the rules of a chain of the MemoryBackend, in order and without their ownership comments
+func assertChain(t *testing.T, b *MemoryBackend, table Table, chain Chain, expected ...string) {
+	t.Helper()
+
+	rules, err := b.List(TableChain{table, chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := make([]string, len(rules))
+	for index, rule := range rules {
+		actual[index] = strings.Join(rule.untagged().spec, " ")
+	}
+
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected rules in chain %s (table %s):\n%s\nexpected:\n%s", chain, table,
+			strings.Join(actual, "\n"), strings.Join(expected, "\n"))
+	}
+}
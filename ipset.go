@@ -0,0 +1,228 @@
+package dockeripv6nat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ipSetPrefix is prepended to the names of the sets, to keep them apart from other ipsets
+const ipSetPrefix = "ipv6nat-"
+
+// ipSetNamePattern limits the names of the sets, which can be at most 31 characters (including the prefix)
+var ipSetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,23}$`)
+
+// IPSets manages named sets of IPv6 prefixes (ipsets of type hash:net, family inet6)
+type IPSets interface {
+	// Ensure creates the set if it doesn't exist yet and makes the given prefixes its only members
+	Ensure(name string, prefixes []*net.IPNet) error
+	// Remove destroys the set
+	Remove(name string) error
+}
+
+// IPSetConfig holds the sets of prefixes to manage, and the sets to block traffic from
+type IPSetConfig struct {
+	sets  map[string][]*net.IPNet
+	block []string
+}
+
+// ipSetConfigFile is the JSON representation of an IPSetConfig, e.g.
+//
+//	{"sets": {"office": ["2001:db8::/32"], "abusers": ["2001:db8:bad::/48"]}, "block": ["abusers"]}
+type ipSetConfigFile struct {
+	Sets  map[string][]string `json:"sets"`
+	Block []string            `json:"block"`
+}
+
+// NewIPSetConfig constructs a new, empty IPSetConfig
+func NewIPSetConfig() *IPSetConfig {
+	return &IPSetConfig{
+		sets: make(map[string][]*net.IPNet),
+	}
+}
+
+// LoadIPSetConfig reads an IPSetConfig from the given JSON file
+func LoadIPSetConfig(path string) (*IPSetConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file ipSetConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid ipset config %s: %v", path, err)
+	}
+
+	config := NewIPSetConfig()
+	for name, values := range file.Sets {
+		if !ipSetNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid ipset name %s in %s", name, path)
+		}
+
+		prefixes := make([]*net.IPNet, len(values))
+		for index, value := range values {
+			_, prefix, err := net.ParseCIDR(value)
+			if err != nil || prefix.IP.To4() != nil {
+				return nil, fmt.Errorf("invalid IPv6 prefix %s in ipset %s", value, name)
+			}
+			if ones, _ := prefix.Mask.Size(); ones == 0 {
+				return nil, fmt.Errorf("invalid IPv6 prefix %s in ipset %s (hash:net does not support /0)", value, name)
+			}
+			prefixes[index] = prefix
+		}
+		config.sets[name] = prefixes
+	}
+
+	for _, name := range file.Block {
+		if !config.Has(name) {
+			return nil, fmt.Errorf("unknown ipset %s to block in %s", name, path)
+		}
+		config.block = append(config.block, name)
+	}
+
+	return config, nil
+}
+
+// Has checks if the set with the given name exists in the config
+func (c *IPSetConfig) Has(name string) bool {
+	_, exists := c.sets[name]
+	return exists
+}
+
+// names returns the names of all sets, sorted
+func (c *IPSetConfig) names() []string {
+	names := make([]string, 0, len(c.sets))
+	for name := range c.sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func ipSetName(name string) string {
+	return ipSetPrefix + name
+}
+
+// NetlinkIPSets is the IPSets managing the sets in the kernel, over netlink
+type NetlinkIPSets struct{}
+
+// NewNetlinkIPSets constructs a new NetlinkIPSets
+func NewNetlinkIPSets() *NetlinkIPSets {
+	return &NetlinkIPSets{}
+}
+
+// Ensure creates the set if it doesn't exist yet and makes the given prefixes its only members
+func (s *NetlinkIPSets) Ensure(name string, prefixes []*net.IPNet) error {
+	setName := ipSetName(name)
+	result, err := netlink.IpsetList(setName)
+	if err != nil {
+		if err := netlink.IpsetCreate(setName, "hash:net", netlink.IpsetCreateOptions{Family: uint8(netlink.FAMILY_V6)}); err != nil {
+			return fmt.Errorf("unable to create ipset %s: %v", setName, err)
+		}
+		result = &netlink.IPSetResult{}
+	}
+
+	// Only add and delete the differences, so unchanged members keep matching throughout.
+	wanted := make(map[string]*net.IPNet, len(prefixes))
+	for _, prefix := range prefixes {
+		wanted[prefix.String()] = prefix
+	}
+
+	for _, entry := range result.Entries {
+		key := (&net.IPNet{IP: entry.IP, Mask: net.CIDRMask(int(entry.CIDR), 128)}).String()
+		if _, exists := wanted[key]; exists {
+			delete(wanted, key)
+			continue
+		}
+
+		if err := netlink.IpsetDel(setName, &netlink.IPSetEntry{IP: entry.IP, CIDR: entry.CIDR}); err != nil {
+			return fmt.Errorf("unable to delete %s from ipset %s: %v", key, setName, err)
+		}
+	}
+
+	for key, prefix := range wanted {
+		ones, _ := prefix.Mask.Size()
+		if err := netlink.IpsetAdd(setName, &netlink.IPSetEntry{IP: prefix.IP, CIDR: uint8(ones)}); err != nil {
+			return fmt.Errorf("unable to add %s to ipset %s: %v", key, setName, err)
+		}
+	}
+
+	return nil
+}
+
+// Remove destroys the set
+func (s *NetlinkIPSets) Remove(name string) error {
+	return netlink.IpsetDestroy(ipSetName(name))
+}
+
+// DryRunIPSets is the IPSets that only logs the ipset commands it would run, keeping track of the members in memory
+type DryRunIPSets struct {
+	logger *log.Logger
+	sets   map[string]map[string]bool
+}
+
+// NewDryRunIPSets constructs a new DryRunIPSets, logging the commands to the given Logger
+func NewDryRunIPSets(logger *log.Logger) *DryRunIPSets {
+	return &DryRunIPSets{
+		logger: logger,
+		sets:   make(map[string]map[string]bool),
+	}
+}
+
+// Ensure creates the set if it doesn't exist yet and makes the given prefixes its only members
+func (s *DryRunIPSets) Ensure(name string, prefixes []*net.IPNet) error {
+	setName := ipSetName(name)
+	members, exists := s.sets[setName]
+	if !exists {
+		s.logger.Println("ipset create", setName, "hash:net family inet6 -exist")
+		members = make(map[string]bool)
+		s.sets[setName] = members
+	}
+
+	// Only log the differences, like the NetlinkIPSets only applies those.
+	wanted := make(map[string]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		wanted[prefix.String()] = true
+	}
+
+	for _, key := range sortedKeys(members) {
+		if !wanted[key] {
+			s.logger.Println("ipset del", setName, key)
+			delete(members, key)
+		}
+	}
+
+	for _, key := range sortedKeys(wanted) {
+		if !members[key] {
+			s.logger.Println("ipset add", setName, key)
+			members[key] = true
+		}
+	}
+
+	return nil
+}
+
+// Remove destroys the set
+func (s *DryRunIPSets) Remove(name string) error {
+	setName := ipSetName(name)
+	delete(s.sets, setName)
+	s.logger.Println("ipset destroy", setName)
+	return nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
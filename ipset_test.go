@@ -0,0 +1,65 @@
+package dockeripv6nat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadIPSetConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		sets  map[string][]string
+		block []string
+	}{
+		{"empty", `{}`, map[string][]string{}, nil},
+		{"sets", `{"sets": {"office": ["2001:db8::/32", "fd00:1::/64"], "abusers": ["2001:db8:bad::/48"]}, "block": ["abusers"]}`,
+			map[string][]string{"office": {"2001:db8::/32", "fd00:1::/64"}, "abusers": {"2001:db8:bad::/48"}}, []string{"abusers"}},
+		{"host prefix", `{"sets": {"admin": ["2001:db8::1/128"]}}`, map[string][]string{"admin": {"2001:db8::1/128"}}, nil},
+		{"invalid json", `{"sets": [`, nil, nil},
+		{"invalid name", `{"sets": {"no spaces": ["2001:db8::/32"]}}`, nil, nil},
+		{"long name", `{"sets": {"abcdefghijklmnopqrstuvwxyz": ["2001:db8::/32"]}}`, nil, nil},
+		{"ipv4 prefix", `{"sets": {"office": ["192.0.2.0/24"]}}`, nil, nil},
+		{"address", `{"sets": {"office": ["2001:db8::1"]}}`, nil, nil},
+		{"default route", `{"sets": {"everyone": ["::/0"]}}`, nil, nil},
+		{"unknown block", `{"sets": {"office": ["2001:db8::/32"]}, "block": ["abusers"]}`, nil, nil},
+	}
+
+	dir := t.TempDir()
+	for index, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("ipsets%d.json", index))
+		if err := os.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := LoadIPSetConfig(path)
+		if test.sets == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+
+		sets := make(map[string][]string, len(config.sets))
+		for name, prefixes := range config.sets {
+			sets[name] = make([]string, len(prefixes))
+			for index, prefix := range prefixes {
+				sets[name][index] = prefix.String()
+			}
+		}
+		if !reflect.DeepEqual(sets, test.sets) || !reflect.DeepEqual(config.block, test.block) {
+			t.Errorf("%s: unexpected sets %v (block %v), expected %v (block %v)", test.name, sets, config.block, test.sets, test.block)
+		}
+	}
+
+	if _, err := LoadIPSetConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,291 @@
+package dockeripv6nat
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// restoreFailedLine matches the line number in the error output of ip6tables-restore
+var restoreFailedLine = regexp.MustCompile(`line (\d+)`)
+
+// IP6TablesBackend is the Backend using the ip6tables binaries
+type IP6TablesBackend struct {
+	ipt         *iptables.IPTables
+	restorePath string
+	restoreWait bool
+}
+
+// NewIP6TablesBackend constructs a new IP6TablesBackend, using the binaries of the given (resolved) xtables mode
+func NewIP6TablesBackend(xtablesMode string) (*IP6TablesBackend, error) {
+	ipt, err := iptables.New(
+		iptables.IPFamily(iptables.ProtocolIPv6),
+		iptables.Path(xtablesBinary("ip6tables", "", xtablesMode)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	restorePath, err := exec.LookPath(xtablesBinary("ip6tables", "-restore", xtablesMode))
+	if err != nil {
+		return nil, err
+	}
+
+	// ip6tables-restore supports --wait since 1.6.2
+	v1, v2, v3 := ipt.GetIptablesVersion()
+	restoreWait := v1 > 1 || (v1 == 1 && (v2 > 6 || (v2 == 6 && v3 >= 2)))
+
+	return &IP6TablesBackend{
+		ipt:         ipt,
+		restorePath: restorePath,
+		restoreWait: restoreWait,
+	}, nil
+}
+
+// EnsureChain creates the given chain if it doesn't exist yet, optionally clearing it
+func (b *IP6TablesBackend) EnsureChain(tc TableChain, clear bool) error {
+	if clear {
+		return b.ipt.ClearChain(string(tc.table), string(tc.chain))
+	}
+
+	chains, err := b.ipt.ListChains(string(tc.table))
+	if err != nil {
+		return err
+	}
+
+	for _, chain := range chains {
+		if chain == string(tc.chain) {
+			return nil
+		}
+	}
+
+	return b.ipt.NewChain(string(tc.table), string(tc.chain))
+}
+
+// RemoveChain clears and deletes the given chain
+func (b *IP6TablesBackend) RemoveChain(tc TableChain) error {
+	if err := b.ipt.ClearChain(string(tc.table), string(tc.chain)); err != nil {
+		return err
+	}
+
+	return b.ipt.DeleteChain(string(tc.table), string(tc.chain))
+}
+
+// List returns the rules in the given chain, in order
+func (b *IP6TablesBackend) List(tc TableChain) ([]*Rule, error) {
+	lines, err := b.ipt.List(string(tc.table), string(tc.chain))
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*Rule, 0, len(lines))
+	for _, line := range lines {
+		args := splitRuleLine(line)
+		if len(args) < 2 || args[0] != "-A" {
+			// Skip the -P (policy) and -N (new chain) lines.
+			continue
+		}
+		rules = append(rules, NewRule(tc.table, tc.chain, args[2:]...))
+	}
+
+	return rules, nil
+}
+
+// ListCounters returns the rules in the given chain along with their counters, in order
+func (b *IP6TablesBackend) ListCounters(tc TableChain) ([]RuleCounters, error) {
+	lines, err := b.ipt.ListWithCounters(string(tc.table), string(tc.chain))
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make([]RuleCounters, 0, len(lines))
+	for _, line := range lines {
+		args := splitRuleLine(line)
+		if len(args) < 2 || args[0] != "-A" {
+			continue
+		}
+
+		// The counters are listed as "-c <packets> <bytes>" between the rule arguments.
+		var packets, bytes uint64
+		spec := make([]string, 0, len(args))
+		for index := 2; index < len(args); index++ {
+			if args[index] == "-c" && index+2 < len(args) {
+				packets, _ = strconv.ParseUint(args[index+1], 10, 64)
+				bytes, _ = strconv.ParseUint(args[index+2], 10, 64)
+				index += 2
+				continue
+			}
+			spec = append(spec, args[index])
+		}
+
+		counters = append(counters, RuleCounters{
+			Rule:    NewRule(tc.table, tc.chain, spec...),
+			Packets: packets,
+			Bytes:   bytes,
+		})
+	}
+
+	return counters, nil
+}
+
+// Exists checks if the given rule exists
+func (b *IP6TablesBackend) Exists(r *Rule) (bool, error) {
+	return b.ipt.Exists(string(r.tc.table), string(r.tc.chain), r.spec...)
+}
+
+// Insert adds the given rule at the given (1-based) position of its chain
+func (b *IP6TablesBackend) Insert(r *Rule, position int) error {
+	return b.ipt.Insert(string(r.tc.table), string(r.tc.chain), position, r.spec...)
+}
+
+// Delete removes the given rule from its chain
+func (b *IP6TablesBackend) Delete(r *Rule) error {
+	return b.ipt.Delete(string(r.tc.table), string(r.tc.chain), r.spec...)
+}
+
+// Apply performs all changes of the Transaction using a single ip6tables-restore --noflush.
+// Since ip6tables-restore commits table by table, any tables committed before a failure are rolled back.
+func (b *IP6TablesBackend) Apply(tx Transaction) error {
+	input, commitLines := restoreInput(tx)
+	output, err := b.restore(input)
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("ip6tables-restore failed: %v: %s", err, strings.TrimSpace(string(output)))
+
+	// Without a line number, assume nothing was committed
+	failedLine := 0
+	if match := restoreFailedLine.FindSubmatch(output); match != nil {
+		failedLine, _ = strconv.Atoi(string(match[1]))
+	}
+
+	committed := make(map[Table]bool)
+	for table, line := range commitLines {
+		if line < failedLine {
+			committed[table] = true
+		}
+	}
+
+	rollback := make(Transaction, 0, len(tx))
+	for _, change := range tx.Inverse() {
+		if committed[change.Rule.tc.table] {
+			rollback = append(rollback, change)
+		}
+	}
+
+	if len(rollback) > 0 {
+		rollbackInput, _ := restoreInput(rollback)
+		if output, rollbackErr := b.restore(rollbackInput); rollbackErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v: %s)", err, rollbackErr, strings.TrimSpace(string(output)))
+		}
+	}
+
+	return err
+}
+
+func (b *IP6TablesBackend) restore(input []byte) ([]byte, error) {
+	args := []string{"--noflush"}
+	if b.restoreWait {
+		args = append(args, "--wait")
+	}
+
+	cmd := exec.Command(b.restorePath, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.CombinedOutput()
+}
+
+// restoreInput generates the ip6tables-restore input for the Transaction, along with the line number of each COMMIT
+func restoreInput(tx Transaction) ([]byte, map[Table]int) {
+	tables := make([]Table, 0, 2)
+	lines := make(map[Table][]string)
+	for _, change := range tx {
+		table := change.Rule.tc.table
+		if _, exists := lines[table]; !exists {
+			tables = append(tables, table)
+		}
+
+		lines[table] = append(lines[table], strings.Join(changeArgs(change), " "))
+	}
+
+	var input bytes.Buffer
+	commitLines := make(map[Table]int)
+	lineNumber := 0
+	for _, table := range tables {
+		fmt.Fprintf(&input, "*%s\n", table)
+		for _, line := range lines[table] {
+			fmt.Fprintln(&input, line)
+		}
+		fmt.Fprintln(&input, "COMMIT")
+		lineNumber += len(lines[table]) + 2
+		commitLines[table] = lineNumber
+	}
+
+	return input.Bytes(), commitLines
+}
+
+// changeArgs returns the (quoted) ip6tables arguments for a RuleChange, excluding the table
+func changeArgs(change *RuleChange) []string {
+	args := make([]string, 0, len(change.Rule.spec)+3)
+	if change.Delete {
+		args = append(args, "-D", string(change.Rule.tc.chain))
+	} else {
+		args = append(args, "-I", string(change.Rule.tc.chain), strconv.Itoa(change.Position))
+	}
+	for _, arg := range change.Rule.spec {
+		args = append(args, quoteRuleArg(arg))
+	}
+
+	return args
+}
+
+// quoteRuleArg quotes an argument for ip6tables-restore, if needed
+func quoteRuleArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"\\") {
+		return arg
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// splitRuleLine splits a line of ip6tables -S output into its arguments, taking quotes into account
+func splitRuleLine(line string) []string {
+	args := make([]string, 0)
+	var current strings.Builder
+	inArg := false
+	quoted := false
+	escaped := false
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args
+}
@@ -0,0 +1,115 @@
+package dockeripv6nat
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+)
+
+// rateLimitPattern matches a rate limit with an optional burst, e.g. 50/second or 50/second:100
+var rateLimitPattern = regexp.MustCompile(`^([1-9][0-9]*/(second|minute|hour|day))(:([1-9][0-9]*))?$`)
+
+// PortLimits limits the rate of new connections and the number of concurrent connections to a published port, per
+// source prefix
+type PortLimits struct {
+	rate         string
+	burst        int
+	connections  int
+	prefixLength int
+}
+
+// NewPortLimits constructs new PortLimits from a rate (e.g. 50/second, or 50/second:100 with a burst of 100; empty for
+// no limit), a maximum number of concurrent connections (0 for no limit) and the length of the source prefixes to
+// apply them to
+func NewPortLimits(rate string, connections int, prefixLength int) (*PortLimits, error) {
+	if prefixLength < 1 || prefixLength > 128 {
+		return nil, fmt.Errorf("invalid prefix length %d", prefixLength)
+	}
+
+	if connections < 0 {
+		return nil, fmt.Errorf("invalid connection limit %d", connections)
+	}
+
+	limits := &PortLimits{
+		connections:  connections,
+		prefixLength: prefixLength,
+	}
+
+	if err := limits.setRate(rate); err != nil {
+		return nil, err
+	}
+
+	return limits, nil
+}
+
+// setRate sets the rate limit (and burst) from a string like 50/second:100, or removes it if empty or 0
+func (l *PortLimits) setRate(value string) error {
+	if value == "" || value == "0" {
+		l.rate, l.burst = "", 0
+		return nil
+	}
+
+	match := rateLimitPattern.FindStringSubmatch(value)
+	if match == nil {
+		return fmt.Errorf("invalid rate limit %s", value)
+	}
+
+	l.rate, l.burst = match[1], 0
+	if match[4] != "" {
+		burst, err := strconv.Atoi(match[4])
+		if err != nil {
+			return fmt.Errorf("invalid rate limit %s", value)
+		}
+		l.burst = burst
+	}
+
+	return nil
+}
+
+// setConnections sets the connection limit, or removes it if 0
+func (l *PortLimits) setConnections(value string) error {
+	connections, err := strconv.Atoi(value)
+	if err != nil || connections < 0 {
+		return fmt.Errorf("invalid connection limit %s", value)
+	}
+
+	l.connections = connections
+	return nil
+}
+
+// matches returns the hashlimit and connlimit matches for the limits, with a hashlimit name unique to the given key and
+// the limits themselves, or nil without limits
+func (l *PortLimits) matches(key string) []string {
+	if l.rate == "" && l.connections == 0 {
+		return nil
+	}
+
+	prefixLength := strconv.Itoa(l.prefixLength)
+	matches := make([]string, 0)
+
+	if l.rate != "" {
+		// Names are limited to 15 characters, and should change with the limits to avoid conflicting hashlimit tables.
+		checksum := fnv.New32a()
+		checksum.Write([]byte(fmt.Sprintf("%s#%s#%d#%d", key, l.rate, l.burst, l.prefixLength)))
+
+		matches = append(matches, "-m", "hashlimit", "--hashlimit-upto", l.rate)
+		if l.burst > 0 {
+			matches = append(matches, "--hashlimit-burst", strconv.Itoa(l.burst))
+		}
+		matches = append(matches,
+			"--hashlimit-mode", "srcip",
+			"--hashlimit-srcmask", prefixLength,
+			"--hashlimit-name", fmt.Sprintf("v6nat-%08x", checksum.Sum32()))
+	}
+
+	if l.connections > 0 {
+		matches = append(matches,
+			"-m", "connlimit",
+			"--connlimit-upto", strconv.Itoa(l.connections),
+			"--connlimit-mask", prefixLength,
+			"--connlimit-saddr")
+	}
+
+	return matches
+}
@@ -0,0 +1,102 @@
+package dockeripv6nat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPortLimitsSetRate(t *testing.T) {
+	tests := []struct {
+		value string
+		rate  string
+		burst int
+		valid bool
+	}{
+		{"", "", 0, true},
+		{"0", "", 0, true},
+		{"50/second", "50/second", 0, true},
+		{"50/minute:100", "50/minute", 100, true},
+		{"1/hour", "1/hour", 0, true},
+		{"10/day:5", "10/day", 5, true},
+		{"50", "", 0, false},
+		{"0/second", "", 0, false},
+		{"-1/second", "", 0, false},
+		{"50/week", "", 0, false},
+		{"50/second:", "", 0, false},
+		{"50/second:0", "", 0, false},
+		{"50/second:100:200", "", 0, false},
+	}
+
+	for _, test := range tests {
+		limits := PortLimits{rate: "1/second", burst: 10}
+		err := limits.setRate(test.value)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.value, err)
+			continue
+		}
+		if limits.rate != test.rate || limits.burst != test.burst {
+			t.Errorf("%q: expected rate %q (burst %d), got %q (burst %d)", test.value, test.rate, test.burst, limits.rate,
+				limits.burst)
+		}
+	}
+}
+
+func TestPortLimitsMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  PortLimits
+		matches string
+	}{
+		{"none", PortLimits{prefixLength: 64}, ""},
+		{"rate", PortLimits{rate: "50/second", prefixLength: 64},
+			"-m hashlimit --hashlimit-upto 50/second --hashlimit-mode srcip --hashlimit-srcmask 64 --hashlimit-name v6nat-"},
+		{"burst", PortLimits{rate: "50/second", burst: 100, prefixLength: 56},
+			"-m hashlimit --hashlimit-upto 50/second --hashlimit-burst 100 --hashlimit-mode srcip --hashlimit-srcmask 56 --hashlimit-name v6nat-"},
+		{"connections", PortLimits{connections: 20, prefixLength: 128},
+			"-m connlimit --connlimit-upto 20 --connlimit-mask 128 --connlimit-saddr"},
+		{"both", PortLimits{rate: "1/minute", connections: 2, prefixLength: 64},
+			"-m hashlimit --hashlimit-upto 1/minute --hashlimit-mode srcip --hashlimit-srcmask 64 --hashlimit-name v6nat- -m connlimit --connlimit-upto 2 --connlimit-mask 64 --connlimit-saddr"},
+	}
+
+	for _, test := range tests {
+		matches := test.limits.matches("container web c1 80/tcp")
+		if test.matches == "" {
+			if matches != nil {
+				t.Errorf("%s: expected no matches, got %v", test.name, matches)
+			}
+			continue
+		}
+
+		// The hashlimit name is a checksum, so only its prefix and length are compared
+		actual := strings.Join(matches, " ")
+		for index, match := range matches {
+			if index > 0 && matches[index-1] == "--hashlimit-name" {
+				if len(match) != 14 || !strings.HasPrefix(match, "v6nat-") {
+					t.Errorf("%s: invalid hashlimit name %s", test.name, match)
+				}
+				actual = strings.Replace(actual, match, "v6nat-", 1)
+			}
+		}
+		if actual != test.matches {
+			t.Errorf("%s: unexpected matches:\n%s\nexpected:\n%s", test.name, actual, test.matches)
+		}
+	}
+
+	// The hashlimit name changes with the key and the limits, to avoid conflicting hashlimit tables
+	limits := PortLimits{rate: "50/second", prefixLength: 64}
+	names := make(map[string]bool)
+	for _, key := range []string{"container web c1 80/tcp", "container web c1 443/tcp"} {
+		names[strings.Join(limits.matches(key), " ")] = true
+	}
+	limits.burst = 100
+	names[strings.Join(limits.matches("container web c1 80/tcp"), " ")] = true
+	if len(names) != 3 {
+		t.Errorf("expected 3 different hashlimit names, got %d", len(names))
+	}
+}
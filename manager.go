@@ -2,27 +2,51 @@ package dockeripv6nat
 
 import (
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
 type managedNetwork struct {
 	id         string
+	name       string
 	bridge     string
 	subnet     net.IPNet
 	icc        bool
 	masquerade bool
 	internal   bool
 	binding    net.IP
+	mode       string
+	nptPrefix  *net.IPNet
+	snatFirst  net.IP
+	snatLast   net.IP
 }
 
 type managedContainer struct {
-	id      string
-	bridge  string
-	address net.IP
-	ports   []managedPort
+	id        string
+	name      string
+	group     string
+	endpoints []managedEndpoint
+}
+
+// managedGroup is a load-balancing group: its members (sorted by ID) share the host ports they publish
+type managedGroup struct {
+	name    string
+	members []*managedContainer
+}
+
+type managedEndpoint struct {
+	network       string
+	bridge        string
+	address       net.IP
+	publicAddress net.IP
+	routed        bool
+	ports         []managedPort
 }
 
 type managedPort struct {
@@ -30,25 +54,41 @@ type managedPort struct {
 	proto       string
 	hostAddress net.IP
 	hostPort    uint16
+	allowFrom   []*net.IPNet
+	allowSets   []string
+	blockSets   []string
+	limits      PortLimits
 }
 
+// Gateway modes of a network, see the com.docker.network.bridge.gateway_mode_ipv6 option
+const (
+	GatewayModeNAT            = "nat"
+	GatewayModeNATUnprotected = "nat-unprotected"
+	GatewayModeRouted         = "routed"
+	GatewayModeIsolated       = "isolated"
+)
+
+// baseOwner is the owner in the comment of the base rules
+const baseOwner = "base"
+
+// maxOwnerNameLength limits the name in rule comments, which can be at most 256 characters
+const maxOwnerNameLength = 64
+
 // Manager controls the firewall by managing rules for Docker networks and containers
 type Manager struct {
 	fw          *Firewall
+	conntrack   Conntrack
+	ipsets      IPSets
+	ipSetConfig *IPSetConfig
+	ipSetNames  map[string]bool
 	hairpinMode bool
 }
 
-// NewManager constructs a new Manager
-func NewManager(debug bool) (*Manager, error) {
-	hairpinMode, err := detectHairpinMode()
-	if err != nil {
-		return nil, err
-	}
-
-	fw, err := NewFirewall(debug)
-	if err != nil {
-		return nil, err
-	}
+// NewManager constructs a new Manager on top of the given firewall Backend, deleting the conntrack entries of removed
+// port mappings and containers using the given Conntrack (if not nil) and managing sets using the given IPSets (if not
+// nil, see UpdateIPSets)
+func NewManager(backend Backend, conntrack Conntrack, ipsets IPSets, hairpinMode bool, debug bool) (*Manager, error) {
+	fw := NewFirewall(backend, debug)
 
 	if err := fw.EnsureUserFilterChain(); err != nil {
 		return nil, err
@@ -64,14 +104,27 @@ func NewManager(debug bool) (*Manager, error) {
 
 	return &Manager{
 		fw:          fw,
+		conntrack:   conntrack,
+		ipsets:      ipsets,
+		ipSetConfig: NewIPSetConfig(),
+		ipSetNames:  make(map[string]bool),
 		hairpinMode: hairpinMode,
 	}, nil
 }
 
-func detectHairpinMode() (bool, error) {
-	// Use the IPv4 firewall to detect if the docker daemon is started with --userland-proxy=false.
+// DetectHairpinMode checks if the docker daemon is started with --userland-proxy=false, using the given (resolved) backend
+// and xtables mode
+func DetectHairpinMode(backend, xtablesMode string) (bool, error) {
+	if backend == BackendNFTables {
+		return detectHairpinModeNFTables()
+	}
+
+	// Use the IPv4 firewall, as set up by the docker daemon.
 
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	ipt, err := iptables.New(
+		iptables.IPFamily(iptables.ProtocolIPv4),
+		iptables.Path(xtablesBinary("iptables", "", xtablesMode)),
+	)
 	if err != nil {
 		return false, err
 	}
@@ -112,16 +165,57 @@ func detectHairpinMode() (bool, error) {
 	return false, errors.New("unable to detect hairpin mode (is the docker daemon running?)")
 }
 
-// Cleanup removes the base rules and table-chains (per-network / per-container rules should already be removed)
+// Cleanup removes the base rules, table-chains and sets (per-network / per-container rules should already be removed)
 func (m *Manager) Cleanup() error {
 	if err := m.fw.RemoveRules(getBaseRules(m.hairpinMode)); err != nil {
 		return err
 	}
 
+	if err := m.fw.RemoveRules(getBlockRules(m.ipSetConfig)); err != nil {
+		return err
+	}
+
 	if err := m.fw.RemoveTableChains(getCustomTableChains()); err != nil {
 		return err
 	}
 
+	for name := range m.ipSetNames {
+		if err := m.ipsets.Remove(name); err != nil {
+			return err
+		}
+		delete(m.ipSetNames, name)
+	}
+
+	return nil
+}
+
+// UpdateIPSets applies a (new) IPSetConfig: it updates the members of the sets and the rules blocking traffic from the
+// block sets. Sets no longer in the config are emptied instead of destroyed, since rules may still refer to them.
+func (m *Manager) UpdateIPSets(config *IPSetConfig) error {
+	if m.ipsets == nil {
+		return errors.New("ipsets are not supported")
+	}
+
+	for _, name := range config.names() {
+		if err := m.ipsets.Ensure(name, config.sets[name]); err != nil {
+			return err
+		}
+		m.ipSetNames[name] = true
+	}
+
+	for name := range m.ipSetNames {
+		if !config.Has(name) {
+			if err := m.ipsets.Ensure(name, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := m.applyRules(getBlockRules(m.ipSetConfig), getBlockRules(config)); err != nil {
+		return err
+	}
+
+	m.ipSetConfig = config
 	return nil
 }
 
@@ -130,31 +224,207 @@ func (m *Manager) ReplaceNetwork(oldNetwork, newNetwork *managedNetwork) error {
 	return m.applyRules(getRulesForNetwork(oldNetwork, m.hairpinMode), getRulesForNetwork(newNetwork, m.hairpinMode))
 }
 
+// ReplaceGroup applies relative rule changes for a load-balancing group
+func (m *Manager) ReplaceGroup(oldGroup, newGroup *managedGroup) error {
+	return m.applyRules(getRulesForGroup(oldGroup, m.hairpinMode), getRulesForGroup(newGroup, m.hairpinMode))
+}
+
 // ReplaceContainer applies relative rule changes for a container
 func (m *Manager) ReplaceContainer(oldContainer, newContainer *managedContainer) error {
-	return m.applyRules(getRulesForContainer(oldContainer, m.hairpinMode), getRulesForContainer(newContainer, m.hairpinMode))
+	if err := m.applyRules(getRulesForContainer(oldContainer, m.hairpinMode), getRulesForContainer(newContainer, m.hairpinMode)); err != nil {
+		return err
+	}
+
+	m.deleteConntrack(oldContainer, newContainer)
+	return nil
 }
 
-func (m *Manager) applyRules(oldRules, newRules *Ruleset) error {
-	oldRules = oldRules.Diff(newRules)
+// deleteConntrack deletes the conntrack entries of the port mappings (or the whole container endpoint) that have been
+// removed, or of the whole endpoint if its public address changed. Failures are only logged, since the rules have been
+// applied already.
+func (m *Manager) deleteConntrack(oldContainer, newContainer *managedContainer) {
+	if m.conntrack == nil || oldContainer == nil {
+		return
+	}
 
-	if err := m.fw.EnsureRules(newRules); err != nil {
-		return err
+	for _, oldEndpoint := range oldContainer.endpoints {
+		newEndpoint := newContainer.endpoint(oldEndpoint.address)
+		if newEndpoint == nil || !newEndpoint.publicAddress.Equal(oldEndpoint.publicAddress) {
+			if err := m.conntrack.DeleteAddress(oldEndpoint.address); err != nil {
+				log.Printf("unable to delete conntrack entries for %s: %v", oldEndpoint.address, err)
+			}
+		}
+
+		for _, port := range oldEndpoint.ports {
+			if newEndpoint != nil && newEndpoint.hasPort(port) {
+				continue
+			}
+
+			// Only the flows translated to this endpoint are deleted, so other members of a group keep theirs. Routed
+			// endpoints don't use the host port, their flows go to the container port directly.
+			hostAddress, hostPort := port.hostAddress, port.hostPort
+			if oldEndpoint.routed {
+				hostAddress, hostPort = oldEndpoint.address, port.port
+			}
+			if err := m.conntrack.DeletePort(port.proto, hostAddress, hostPort, oldEndpoint.address, port.port); err != nil {
+				log.Printf("unable to delete conntrack entries for port %d/%s: %v", hostPort, port.proto, err)
+			}
+		}
 	}
+}
 
-	if err := m.fw.RemoveRules(oldRules); err != nil {
-		return err
+// endpoint returns the endpoint of the container with the given address, or nil if there is none
+func (container *managedContainer) endpoint(address net.IP) *managedEndpoint {
+	if container == nil {
+		return nil
+	}
+
+	for index := range container.endpoints {
+		if container.endpoints[index].address.Equal(address) {
+			return &container.endpoints[index]
+		}
 	}
 
 	return nil
 }
 
+func (endpoint *managedEndpoint) hasPort(port managedPort) bool {
+	for _, other := range endpoint.ports {
+		if other.port == port.port && other.proto == port.proto && other.hostPort == port.hostPort && other.hostAddress.Equal(port.hostAddress) &&
+			equalPrefixes(other.allowFrom, port.allowFrom) && equalStrings(other.allowSets, port.allowSets) && equalStrings(other.blockSets, port.blockSets) &&
+			other.limits == port.limits {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equalPrefixes(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if a[index].String() != b[index].String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reconcile repairs any drift between the firewall and the rules for the given networks, containers and groups,
+// returning the number of drifted rules
+func (m *Manager) Reconcile(networks []*managedNetwork, containers []*managedContainer, groups []*managedGroup) (int, error) {
+	rules := *getBaseRules(m.hairpinMode)
+	rules = append(rules, *getBlockRules(m.ipSetConfig)...)
+	for _, network := range networks {
+		rules = append(rules, *getRulesForNetwork(network, m.hairpinMode)...)
+	}
+	for _, container := range containers {
+		rules = append(rules, *getRulesForContainer(container, m.hairpinMode)...)
+	}
+	for _, group := range groups {
+		rules = append(rules, *getRulesForGroup(group, m.hairpinMode)...)
+	}
+
+	return m.fw.Reconcile(&rules)
+}
+
+func (m *Manager) applyRules(oldRules, newRules *Ruleset) error {
+	return m.fw.ApplyRules(newRules, oldRules.Diff(newRules))
+}
+
+func (network *managedNetwork) owner() string {
+	return ownerString("network", network.name, network.id)
+}
+
+// snatRange returns the SNAT address (range) in the format of --to-source, or an empty string without SNAT
+func (network *managedNetwork) snatRange() string {
+	if network.snatFirst == nil {
+		return ""
+	}
+
+	if network.snatLast == nil {
+		return network.snatFirst.String()
+	}
+
+	return network.snatFirst.String() + "-" + network.snatLast.String()
+}
+
+// isolated checks if the network is cut off from other networks, either by being internal or by its gateway mode
+func (network *managedNetwork) isolated() bool {
+	return network.internal || network.mode == GatewayModeIsolated
+}
+
+func (container *managedContainer) owner() string {
+	return ownerString("container", container.name, container.id)
+}
+
+// owner identifies the group by its members instead of an ID, so all of its rules are replaced (and stay in order)
+// whenever a member joins or leaves
+// owner includes a checksum of the members and their targets, so all rules of the group are replaced together (keeping
+// their statistic matches in order) whenever any of them changes
+func (group *managedGroup) owner() string {
+	checksum := fnv.New32a()
+	for _, member := range group.members {
+		checksum.Write([]byte(member.id + "#"))
+		for _, endpoint := range member.endpoints {
+			if endpoint.routed {
+				continue
+			}
+
+			for _, port := range endpoint.ports {
+				fmt.Fprintf(checksum, "%s#%d/%s#%s#%d#", endpoint.address, port.port, port.proto, port.hostAddress, port.hostPort)
+			}
+		}
+	}
+
+	return ownerString("group", group.name, fmt.Sprintf("%08x", checksum.Sum32()))
+}
+
+// ownerString identifies the owner of a rule by kind, name and (short) ID, e.g. "container web 0123456789ab"
+func ownerString(kind, name, id string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '"' || r == '\\' || r > '~' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "-"
+	} else if len(name) > maxOwnerNameLength {
+		name = name[:maxOwnerNameLength]
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	return kind + " " + name + " " + id
+}
+
 func getCustomTableChains() []TableChain {
 	return []TableChain{
 		{TableFilter, ChainDocker},
 		{TableFilter, ChainDockerIsolation1},
 		{TableFilter, ChainDockerIsolation2},
 		{TableNat, ChainDocker},
+		{TableNat, ChainSNAT},
 	}
 }
 
@@ -168,11 +438,14 @@ func getBaseRules(hairpinMode bool) *Ruleset {
 		outputRule.spec = append(outputRule.spec, "!", "-d", "::1")
 	}
 
-	return &Ruleset{
+	return (&Ruleset{
 		NewPrependRule(TableFilter, ChainForward,
 			"-j", ChainDockerUser),
 		NewPrependRule(TableFilter, ChainForward,
 			"-j", ChainDockerIsolation1),
+		// The per-container SNAT goes before the (prepended) MASQUERADE and SNAT of the networks
+		NewPrependRule(TableNat, ChainPostrouting,
+			"-j", ChainSNAT),
 		NewRule(TableFilter, ChainDockerIsolation1,
 			"-j", "RETURN"),
 		NewRule(TableFilter, ChainDockerIsolation2,
@@ -182,7 +455,20 @@ func getBaseRules(hairpinMode bool) *Ruleset {
 			"--dst-type", "LOCAL",
 			"-j", ChainDocker),
 		outputRule,
+	}).Tag(baseOwner)
+}
+
+// getBlockRules returns the rules dropping all forwarded traffic from the block sets
+func getBlockRules(config *IPSetConfig) *Ruleset {
+	rs := make(Ruleset, len(config.block))
+	for index, name := range config.block {
+		rs[index] = NewPrependRule(TableFilter, ChainDockerUser,
+			"-m", "set",
+			"--match-set", ipSetName(name), "src",
+			"-j", "DROP")
 	}
+
+	return rs.Tag(baseOwner)
 }
 
 func getRulesForNetwork(network *managedNetwork, hairpinMode bool) *Ruleset {
@@ -195,8 +481,8 @@ func getRulesForNetwork(network *managedNetwork, hairpinMode bool) *Ruleset {
 		iccAction = "DROP"
 	}
 
-	if network.internal {
-		return &Ruleset{
+	if network.isolated() {
+		return (&Ruleset{
 			// internal: drop traffic to docker network from foreign subnet
 			// notice: rule is different from IPv4 counterpart because NDP should not be blocked
 			NewPrependRule(TableFilter, ChainDockerIsolation1,
@@ -214,7 +500,11 @@ func getRulesForNetwork(network *managedNetwork, hairpinMode bool) *Ruleset {
 				"-i", network.bridge,
 				"-o", network.bridge,
 				"-j", iccAction),
-		}
+		}).Tag(network.owner())
+	}
+
+	if network.mode == GatewayModeRouted {
+		return getRoutedRulesForNetwork(network, iccAction)
 	}
 
 	rs := Ruleset{
@@ -255,7 +545,31 @@ func getRulesForNetwork(network *managedNetwork, hairpinMode bool) *Ruleset {
 			"-j", "MASQUERADE"),
 	}
 
-	if network.masquerade {
+	if network.nptPrefix != nil {
+		rs = append(rs,
+			// translate the source prefix of packets leaving the docker network (NPTv6)
+			NewPrependRule(TableNat, ChainPostrouting,
+				"-s", network.subnet.String(),
+				"!", "-o", network.bridge,
+				"-j", "NETMAP",
+				"--to", network.nptPrefix.String()),
+			// translate the destination prefix of packets entering the docker network (NPTv6)
+			NewPrependRule(TableNat, ChainPrerouting,
+				"-d", network.nptPrefix.String(),
+				"!", "-i", network.bridge,
+				"-j", "NETMAP",
+				"--to", network.subnet.String()),
+		)
+	} else if network.snatFirst != nil {
+		rs = append(rs,
+			// translate the source of packets leaving the docker network to a fixed address (range)
+			NewPrependRule(TableNat, ChainPostrouting,
+				"-s", network.subnet.String(),
+				"!", "-o", network.bridge,
+				"-j", "SNAT",
+				"--to-source", network.snatRange()),
+		)
+	} else if network.masquerade {
 		rs = append(rs,
 			// masquerade packets if they leave the docker network
 			NewPrependRule(TableNat, ChainPostrouting,
@@ -265,13 +579,69 @@ func getRulesForNetwork(network *managedNetwork, hairpinMode bool) *Ruleset {
 		)
 	}
 
+	if network.mode == GatewayModeNATUnprotected {
+		// nat-unprotected: allow ingoing traffic to all ports of the docker network, not just the published ones
+		rs = append(rs, NewRule(TableFilter, ChainDocker,
+			"!", "-i", network.bridge,
+			"-o", network.bridge,
+			"-j", "ACCEPT"))
+	} else {
+		// nat: drop all other ingoing traffic to docker network, e.g. routed to its containers directly (global
+		// subnet) or through NPTv6
+		rs = append(rs, NewRule(TableFilter, ChainForward,
+			"!", "-i", network.bridge,
+			"-o", network.bridge,
+			"-j", "DROP"))
+	}
+
 	if !hairpinMode {
 		rs = append(rs, NewPrependRule(TableNat, ChainDocker,
 			"-i", network.bridge,
 			"-j", "RETURN"))
 	}
 
-	return &rs
+	return rs.Tag(network.owner())
+}
+
+// getRoutedRulesForNetwork returns the rules for a network in routed mode: its containers are directly reachable
+// (without NAT), but only on their published ports
+func getRoutedRulesForNetwork(network *managedNetwork, iccAction string) *Ruleset {
+	return (&Ruleset{
+		// routed: catch if packet wants to leave docker network (stage 1)
+		NewPrependRule(TableFilter, ChainDockerIsolation1,
+			"-i", network.bridge,
+			"!", "-o", network.bridge,
+			"-j", ChainDockerIsolation2),
+		// routed: if packet wants to enter another docker network, drop it (stage 2)
+		NewPrependRule(TableFilter, ChainDockerIsolation2,
+			"-o", network.bridge,
+			"-j", "DROP"),
+		// routed: check ingoing traffic to docker network for new connections (published ports) in additional chain
+		NewRule(TableFilter, ChainForward,
+			"-o", network.bridge,
+			"-j", ChainDocker),
+		// routed: allow ingoing traffic to docker network for established connections
+		NewRule(TableFilter, ChainForward,
+			"-o", network.bridge,
+			"-m", "conntrack",
+			"--ctstate", "RELATED,ESTABLISHED",
+			"-j", "ACCEPT"),
+		// routed: allow outgoing traffic from docker network
+		NewRule(TableFilter, ChainForward,
+			"-i", network.bridge,
+			"!", "-o", network.bridge,
+			"-j", "ACCEPT"),
+		// ICC
+		NewRule(TableFilter, ChainForward,
+			"-i", network.bridge,
+			"-o", network.bridge,
+			"-j", iccAction),
+		// routed: drop all other ingoing traffic to docker network
+		NewRule(TableFilter, ChainForward,
+			"!", "-i", network.bridge,
+			"-o", network.bridge,
+			"-j", "DROP"),
+	}).Tag(network.owner())
 }
 
 func getRulesForContainer(container *managedContainer, hairpinMode bool) *Ruleset {
@@ -279,50 +649,185 @@ func getRulesForContainer(container *managedContainer, hairpinMode bool) *Rulese
 		return &Ruleset{}
 	}
 
-	rs := make(Ruleset, 0, len(container.ports)*3)
-	for _, port := range container.ports {
-		rs = append(rs, *getRulesForPort(&port, container, hairpinMode)...)
+	rs := make(Ruleset, 0)
+	for _, endpoint := range container.endpoints {
+		if endpoint.publicAddress != nil {
+			rs = append(rs, NewRule(TableNat, ChainSNAT,
+				"-s", endpoint.address.String(),
+				"!", "-o", endpoint.bridge,
+				"-j", "SNAT",
+				"--to-source", endpoint.publicAddress.String()))
+		}
+
+		for _, port := range endpoint.ports {
+			rs = append(rs, *getRulesForPort(&port, &endpoint, container.group != "", hairpinMode)...)
+		}
 	}
 
-	return &rs
+	return rs.Tag(container.owner())
+}
+
+// groupTarget is a port of a group member to translate a host port of the group to
+type groupTarget struct {
+	port     *managedPort
+	endpoint *managedEndpoint
+}
+
+func getRulesForGroup(group *managedGroup, hairpinMode bool) *Ruleset {
+	if group == nil {
+		return &Ruleset{}
+	}
+
+	// Collect the members' ports by host port, routed ports can't be shared (nor translated at all).
+	keys := make([]string, 0)
+	targets := make(map[string][]groupTarget)
+	for _, member := range group.members {
+		for endpointIndex := range member.endpoints {
+			endpoint := &member.endpoints[endpointIndex]
+			if endpoint.routed {
+				continue
+			}
+
+			for portIndex := range endpoint.ports {
+				port := &endpoint.ports[portIndex]
+				key := port.proto + "#" + port.hostAddress.String() + "#" + strconv.Itoa(int(port.hostPort))
+				if _, exists := targets[key]; !exists {
+					keys = append(keys, key)
+				}
+				targets[key] = append(targets[key], groupTarget{port, endpoint})
+			}
+		}
+	}
+
+	rs := make(Ruleset, 0)
+	for _, key := range keys {
+		// The sources and limits of the first member apply to the whole host port.
+		first := targets[key][0].port
+		sources, blocked := getSourceMatches(first)
+		limits := first.limits.matches("group#" + group.name + "#" + key)
+
+		// Every rule takes an equal share of the connections left over by the rules before it: 1/n, 1/(n-1), ... and
+		// the last one takes the rest.
+		for _, source := range sources {
+			for index, target := range targets[key] {
+				matches := append([]string{}, blocked...)
+				if remaining := len(targets[key]) - index; remaining > 1 {
+					matches = append(matches, "-m", "statistic", "--mode", "nth", "--every", strconv.Itoa(remaining), "--packet", "0")
+				}
+				matches = append(matches, limits...)
+
+				rs = append(rs, getDNATRule(target.port, target.endpoint, withSource(source, matches), hairpinMode))
+			}
+		}
+	}
+
+	return rs.Tag(group.owner())
 }
 
-func getRulesForPort(port *managedPort, container *managedContainer, hairpinMode bool) *Ruleset {
+// getRulesForPort returns the rules to publish a port, without the DNAT rules if the port is balanced (and translated
+// by its group instead)
+func getRulesForPort(port *managedPort, endpoint *managedEndpoint, balanced bool, hairpinMode bool) *Ruleset {
 	containerPortString := strconv.Itoa(int(port.port))
-	hostPortString := strconv.Itoa(int(port.hostPort))
+	sources, blocked := getSourceMatches(port)
+
+	// Limit new connections before they are translated (or accepted directly, when routed).
+	filterMatches, natMatches := blocked, blocked
+	limitKey := endpoint.address.String() + "#" + port.proto + "#" + containerPortString + "#" + port.hostAddress.String() + "#" + strconv.Itoa(int(port.hostPort))
+	if limits := port.limits.matches(limitKey); limits != nil {
+		if endpoint.routed {
+			filterMatches = append(append(append([]string{}, blocked...), "-m", "conntrack", "--ctstate", "NEW"), limits...)
+		} else {
+			natMatches = append(append([]string{}, blocked...), limits...)
+		}
+	}
+
+	rs := make(Ruleset, 0, len(sources)*2+1)
+	for _, source := range sources {
+		rs = append(rs, NewRule(TableFilter, ChainDocker, withSource(source, filterMatches,
+			"-d", endpoint.address.String(),
+			"!", "-i", endpoint.bridge,
+			"-o", endpoint.bridge,
+			"-p", port.proto,
+			"-m", port.proto,
+			"--dport", containerPortString,
+			"-j", "ACCEPT")...))
+	}
+
+	if endpoint.routed {
+		// Routed: the container port is reachable directly, so there is nothing to translate.
+		return &rs
+	}
+
+	rs = append(rs, NewRule(TableNat, ChainPostrouting,
+		"-s", endpoint.address.String(),
+		"-d", endpoint.address.String(),
+		"-p", port.proto,
+		"-m", port.proto,
+		"--dport", containerPortString,
+		"-j", "MASQUERADE"))
+
+	if balanced {
+		return &rs
+	}
+
+	// Only translate traffic from allowed sources, so other traffic never reaches the container (regardless of the
+	// policy of the FORWARD chain).
+	for _, source := range sources {
+		rs = append(rs, getDNATRule(port, endpoint, withSource(source, natMatches), hairpinMode))
+	}
+
+	return &rs
+}
+
+// getSourceMatches returns the alternative matches for the allowed sources of a port (a single nil match to allow any
+// source), and the matches skipping its blocked sources
+func getSourceMatches(port *managedPort) ([][]string, []string) {
+	sources := [][]string{nil}
+	if port.allowFrom != nil || port.allowSets != nil {
+		sources = make([][]string, 0, len(port.allowFrom)+len(port.allowSets))
+		for _, prefix := range port.allowFrom {
+			sources = append(sources, []string{"-s", prefix.String()})
+		}
+		for _, name := range port.allowSets {
+			sources = append(sources, []string{"-m", "set", "--match-set", ipSetName(name), "src"})
+		}
+	}
+
+	blocked := make([]string, 0, len(port.blockSets)*6)
+	for _, name := range port.blockSets {
+		blocked = append(blocked, "-m", "set", "!", "--match-set", ipSetName(name), "src")
+	}
+
+	return sources, blocked
+}
+
+// getDNATRule returns the rule translating the host port to the port of the container endpoint, for the traffic
+// matching the given matches
+func getDNATRule(port *managedPort, endpoint *managedEndpoint, matches []string, hairpinMode bool) *Rule {
 	hostAddressString := "0/0"
 	if !port.hostAddress.IsUnspecified() {
 		hostAddressString = port.hostAddress.String()
 	}
 
-	dnatRule := NewRule(TableNat, ChainDocker,
+	rule := NewRule(TableNat, ChainDocker, append(matches,
 		"-d", hostAddressString,
 		"-p", port.proto,
 		"-m", port.proto,
-		"--dport", hostPortString,
+		"--dport", strconv.Itoa(int(port.hostPort)),
 		"-j", "DNAT",
-		"--to-destination", net.JoinHostPort(container.address.String(), containerPortString))
+		"--to-destination", net.JoinHostPort(endpoint.address.String(), strconv.Itoa(int(port.port))))...)
 
 	if !hairpinMode {
-		dnatRule.spec = append(dnatRule.spec, "!", "-i", container.bridge)
+		rule.spec = append(rule.spec, "!", "-i", endpoint.bridge)
 	}
 
-	return &Ruleset{
-		NewRule(TableFilter, ChainDocker,
-			"-d", container.address.String(),
-			"!", "-i", container.bridge,
-			"-o", container.bridge,
-			"-p", port.proto,
-			"-m", port.proto,
-			"--dport", containerPortString,
-			"-j", "ACCEPT"),
-		NewRule(TableNat, ChainPostrouting,
-			"-s", container.address.String(),
-			"-d", container.address.String(),
-			"-p", port.proto,
-			"-m", port.proto,
-			"--dport", containerPortString,
-			"-j", "MASQUERADE"),
-		dnatRule,
-	}
+	return rule
+}
+
+// withSource prepends the source match and any other matches (e.g. blocklists) to the rule spec
+func withSource(source, other []string, spec ...string) []string {
+	matches := make([]string, 0, len(source)+len(other)+len(spec))
+	matches = append(matches, source...)
+	matches = append(matches, other...)
+	return append(matches, spec...)
 }
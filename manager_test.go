@@ -0,0 +1,611 @@
+package dockeripv6nat
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestManager(t *testing.T) (*Manager, *MemoryBackend) {
+	t.Helper()
+
+	b := NewMemoryBackend()
+	m, err := NewManager(b, nil, nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, b
+}
+
+func newTestNetwork() *managedNetwork {
+	_, subnet, _ := net.ParseCIDR("fd00:1::/64")
+	return &managedNetwork{
+		id:         "n1",
+		name:       "net",
+		bridge:     "br0",
+		subnet:     *subnet,
+		icc:        true,
+		masquerade: true,
+		binding:    net.ParseIP("::"),
+		mode:       GatewayModeNAT,
+	}
+}
+
+func newTestContainer(id, address string, ports ...managedPort) *managedContainer {
+	return &managedContainer{
+		id:   id,
+		name: "web-" + id,
+		endpoints: []managedEndpoint{{
+			network: "n1",
+			bridge:  "br0",
+			address: net.ParseIP(address),
+			ports:   ports,
+		}},
+	}
+}
+
+func newTestPort(port uint16, proto string, hostPort uint16) managedPort {
+	return managedPort{
+		port:        port,
+		proto:       proto,
+		hostAddress: net.ParseIP("::"),
+		hostPort:    hostPort,
+	}
+}
+
+func TestManagerNetworkAndContainer(t *testing.T) {
+	m, b := newTestManager(t)
+
+	network := newTestNetwork()
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j ACCEPT",
+		"! -i br0 -o br0 -j DROP",
+	)
+	assertChain(t, b, TableNat, ChainPostrouting,
+		"-j DOCKER-IPV6NAT-SNAT",
+		"-o br0 -m addrtype --dst-type LOCAL -j MASQUERADE",
+		"-s fd00:1::/64 ! -o br0 -j MASQUERADE",
+	)
+	assertChain(t, b, TableNat, ChainDocker,
+		"-i br0 -j RETURN",
+	)
+
+	container := newTestContainer("c1", "fd00:1::2", newTestPort(80, "tcp", 8080), newTestPort(53, "udp", 53))
+	if err := m.ReplaceContainer(nil, container); err != nil {
+		t.Fatal(err)
+	}
+
+	assertChain(t, b, TableFilter, ChainDocker,
+		"-d fd00:1::2 ! -i br0 -o br0 -p tcp -m tcp --dport 80 -j ACCEPT",
+		"-d fd00:1::2 ! -i br0 -o br0 -p udp -m udp --dport 53 -j ACCEPT",
+	)
+	assertChain(t, b, TableNat, ChainDocker,
+		"-i br0 -j RETURN",
+		"-d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::2]:80 ! -i br0",
+		"-d 0/0 -p udp -m udp --dport 53 -j DNAT --to-destination [fd00:1::2]:53 ! -i br0",
+	)
+
+	// Replacing keeps the rules in the order of the ports, moving the rules of the ports that follow a new one
+	replaced := newTestContainer("c1", "fd00:1::2", newTestPort(443, "tcp", 8443), newTestPort(53, "udp", 53))
+	if err := m.ReplaceContainer(container, replaced); err != nil {
+		t.Fatal(err)
+	}
+
+	assertChain(t, b, TableFilter, ChainDocker,
+		"-d fd00:1::2 ! -i br0 -o br0 -p tcp -m tcp --dport 443 -j ACCEPT",
+		"-d fd00:1::2 ! -i br0 -o br0 -p udp -m udp --dport 53 -j ACCEPT",
+	)
+	assertChain(t, b, TableNat, ChainDocker,
+		"-i br0 -j RETURN",
+		"-d 0/0 -p tcp -m tcp --dport 8443 -j DNAT --to-destination [fd00:1::2]:443 ! -i br0",
+		"-d 0/0 -p udp -m udp --dport 53 -j DNAT --to-destination [fd00:1::2]:53 ! -i br0",
+	)
+
+	if drifted, err := m.Reconcile([]*managedNetwork{network}, []*managedContainer{replaced}, nil); err != nil || drifted != 0 {
+		t.Fatalf("expected no drift, got %d (%v)", drifted, err)
+	}
+
+	if err := m.ReplaceContainer(replaced, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainDocker)
+	assertChain(t, b, TableNat, ChainDocker,
+		"-i br0 -j RETURN",
+	)
+
+	if err := m.ReplaceNetwork(network, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+	)
+	assertChain(t, b, TableNat, ChainPostrouting,
+		"-j DOCKER-IPV6NAT-SNAT",
+	)
+	assertChain(t, b, TableNat, ChainDocker)
+
+	if err := m.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+	)
+	assertChain(t, b, TableNat, ChainPostrouting)
+}
+
+func TestManagerDuplicatePorts(t *testing.T) {
+	m, b := newTestManager(t)
+
+	network := newTestNetwork()
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 host ports for the same container port share their filter rule
+	container := newTestContainer("c1", "fd00:1::2", newTestPort(80, "tcp", 8080), newTestPort(80, "tcp", 8081))
+	if err := m.ReplaceContainer(nil, container); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainDocker,
+		"-d fd00:1::2 ! -i br0 -o br0 -p tcp -m tcp --dport 80 -j ACCEPT",
+	)
+
+	if drifted, err := m.Reconcile([]*managedNetwork{network}, []*managedContainer{container}, nil); err != nil || drifted != 0 {
+		t.Fatalf("expected no drift, got %d (%v)", drifted, err)
+	}
+
+	if err := m.ReplaceContainer(container, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainDocker)
+}
+
+func TestManagerReconcile(t *testing.T) {
+	b := NewMemoryBackend()
+	if err := b.Insert(NewRule(TableFilter, ChainForward, "-j", "DROP"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewManager(b, nil, nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	network := newTestNetwork()
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	container := newTestContainer("c1", "fd00:1::2", newTestPort(80, "tcp", 8080))
+	if err := m.ReplaceContainer(nil, container); err != nil {
+		t.Fatal(err)
+	}
+
+	networks := []*managedNetwork{network}
+	containers := []*managedContainer{container}
+	if drifted, err := m.Reconcile(networks, containers, nil); err != nil || drifted != 0 {
+		t.Fatalf("expected no drift, got %d (%v)", drifted, err)
+	}
+
+	// Flush some chains (like a firewall reload would), and leave a stale rule of a removed container
+	b.chains[TableChain{TableFilter, ChainForward}] = []*Rule{NewRule(TableFilter, ChainForward, "-j", "DROP")}
+	b.chains[TableChain{TableFilter, ChainDocker}] = nil
+	b.chains[TableChain{TableNat, ChainPostrouting}] = nil
+	if err := b.Insert(NewRule(TableNat, ChainDocker, "-j", "RETURN").Tag("container gone c2"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if drifted, err := m.Reconcile(networks, containers, nil); err != nil || drifted == 0 {
+		t.Fatalf("expected drift, got %d (%v)", drifted, err)
+	}
+
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j ACCEPT",
+		"! -i br0 -o br0 -j DROP",
+		"-j DROP",
+	)
+	assertChain(t, b, TableFilter, ChainDocker,
+		"-d fd00:1::2 ! -i br0 -o br0 -p tcp -m tcp --dport 80 -j ACCEPT",
+	)
+	assertChain(t, b, TableNat, ChainDocker,
+		"-i br0 -j RETURN",
+		"-d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::2]:80 ! -i br0",
+	)
+	assertChain(t, b, TableNat, ChainPostrouting,
+		"-j DOCKER-IPV6NAT-SNAT",
+		"-o br0 -m addrtype --dst-type LOCAL -j MASQUERADE",
+		"-s fd00:1::/64 ! -o br0 -j MASQUERADE",
+		"-s fd00:1::2 -d fd00:1::2 -p tcp -m tcp --dport 80 -j MASQUERADE",
+	)
+
+	if drifted, err := m.Reconcile(networks, containers, nil); err != nil || drifted != 0 {
+		t.Fatalf("expected no drift after reconciling, got %d (%v)", drifted, err)
+	}
+}
+
+func TestManagerReconcileOrder(t *testing.T) {
+	m, b := newTestManager(t)
+
+	network := newTestNetwork()
+	network.mode = GatewayModeRouted
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the DROP of the network above its jump to the DOCKER chain, which drops all published ports
+	forward := TableChain{TableFilter, ChainForward}
+	rules := b.chains[forward]
+	drop := rules[len(rules)-1]
+	reordered := append([]*Rule{}, rules[:2]...)
+	reordered = append(reordered, drop)
+	reordered = append(reordered, rules[2:len(rules)-1]...)
+	b.chains[forward] = reordered
+
+	if drifted, err := m.Reconcile([]*managedNetwork{network}, nil, nil); err != nil || drifted == 0 {
+		t.Fatalf("expected drift, got %d (%v)", drifted, err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j ACCEPT",
+		"! -i br0 -o br0 -j DROP",
+	)
+
+	if drifted, err := m.Reconcile([]*managedNetwork{network}, nil, nil); err != nil || drifted != 0 {
+		t.Fatalf("expected no drift after reconciling, got %d (%v)", drifted, err)
+	}
+
+	// A new rule of the network is inserted in order, instead of after its DROP
+	isolated := *network
+	isolated.icc = false
+	if err := m.ReplaceNetwork(network, &isolated); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j DROP",
+		"! -i br0 -o br0 -j DROP",
+	)
+
+	if drifted, err := m.Reconcile([]*managedNetwork{&isolated}, nil, nil); err != nil || drifted != 0 {
+		t.Fatalf("expected no drift, got %d (%v)", drifted, err)
+	}
+}
+
+func TestManagerReconcileUntagged(t *testing.T) {
+	// Untagged rules of an earlier version, around a rule of someone else
+	b := NewMemoryBackend()
+	b.chains[TableChain{TableFilter, ChainForward}] = []*Rule{
+		NewRule(TableFilter, ChainForward, "-o", "br0", "-j", "DOCKER"),
+		NewRule(TableFilter, ChainForward, "-j", "DROP"),
+		NewRule(TableFilter, ChainForward, "!", "-i", "br0", "-o", "br0", "-j", "DROP"),
+	}
+	b.chains[TableChain{TableNat, ChainPostrouting}] = []*Rule{
+		NewRule(TableNat, ChainPostrouting, "-s", "fd00:1::/64", "!", "-o", "br0", "-j", "MASQUERADE"),
+	}
+
+	m, err := NewManager(b, nil, nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	network := newTestNetwork()
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	// They're only removed by the first Reconcile, which isn't a drift
+	if drifted, err := m.Reconcile([]*managedNetwork{network}, nil, nil); err != nil || drifted != 0 {
+		t.Fatalf("expected no drift, got %d (%v)", drifted, err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j ACCEPT",
+		"! -i br0 -o br0 -j DROP",
+		"-j DROP",
+	)
+	assertChain(t, b, TableNat, ChainPostrouting,
+		"-j DOCKER-IPV6NAT-SNAT",
+		"-o br0 -m addrtype --dst-type LOCAL -j MASQUERADE",
+		"-s fd00:1::/64 ! -o br0 -j MASQUERADE",
+	)
+
+	// Later untagged rules are left alone
+	if err := b.Insert(NewRule(TableFilter, ChainForward, "-o", "br0", "-j", "DOCKER"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if drifted, err := m.Reconcile([]*managedNetwork{network}, nil, nil); err != nil || drifted == 0 {
+		t.Fatalf("expected drift, got %d (%v)", drifted, err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j ACCEPT",
+		"! -i br0 -o br0 -j DROP",
+		"-o br0 -j DOCKER",
+		"-j DROP",
+	)
+}
+
+func TestManagerPublicAddress(t *testing.T) {
+	m, b := newTestManager(t)
+
+	network := newTestNetwork()
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	container := newTestContainer("c1", "fd00:1::2")
+	container.endpoints[0].publicAddress = net.ParseIP("2001:db8::25")
+	if err := m.ReplaceContainer(nil, container); err != nil {
+		t.Fatal(err)
+	}
+
+	assertSNAT := func() {
+		t.Helper()
+		assertChain(t, b, TableNat, ChainPostrouting,
+			"-j DOCKER-IPV6NAT-SNAT",
+			"-o br0 -m addrtype --dst-type LOCAL -j MASQUERADE",
+			"-s fd00:1::/64 ! -o br0 -j MASQUERADE",
+		)
+		assertChain(t, b, TableNat, ChainSNAT,
+			"-s fd00:1::2 ! -o br0 -j SNAT --to-source 2001:db8::25",
+		)
+	}
+	assertSNAT()
+
+	// The network's MASQUERADE is prepended again, but stays below the SNAT of the container
+	unmasqueraded := *network
+	unmasqueraded.masquerade = false
+	if err := m.ReplaceNetwork(network, &unmasqueraded); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReplaceNetwork(&unmasqueraded, network); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := b.List(TableChain{TableNat, ChainPostrouting})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[0].target() != string(ChainSNAT) {
+		t.Errorf("expected the jump to %s on top of %s", ChainSNAT, ChainPostrouting)
+	}
+
+	b.chains[TableChain{TableNat, ChainPostrouting}] = nil
+	if _, err := m.Reconcile([]*managedNetwork{network}, []*managedContainer{container}, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertSNAT()
+}
+
+func TestManagerGroup(t *testing.T) {
+	m, b := newTestManager(t)
+
+	network := newTestNetwork()
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	members := []*managedContainer{
+		newTestContainer("c1", "fd00:1::1", newTestPort(80, "tcp", 8080)),
+		newTestContainer("c2", "fd00:1::2", newTestPort(80, "tcp", 8080)),
+		newTestContainer("c3", "fd00:1::3", newTestPort(80, "tcp", 8080)),
+	}
+	for _, member := range members {
+		member.group = "web"
+		if err := m.ReplaceContainer(nil, member); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each member takes an equal share of what's left over by the members before it
+	group := &managedGroup{name: "web", members: members}
+	if err := m.ReplaceGroup(nil, group); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableNat, ChainDocker,
+		"-i br0 -j RETURN",
+		"-m statistic --mode nth --every 3 --packet 0 -d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::1]:80 ! -i br0",
+		"-m statistic --mode nth --every 2 --packet 0 -d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::2]:80 ! -i br0",
+		"-d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::3]:80 ! -i br0",
+	)
+
+	// Since the rules depend on the order, they are all replaced when a member leaves
+	shrunk := &managedGroup{name: "web", members: []*managedContainer{members[0], members[2]}}
+	if err := m.ReplaceGroup(group, shrunk); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableNat, ChainDocker,
+		"-i br0 -j RETURN",
+		"-m statistic --mode nth --every 2 --packet 0 -d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::1]:80 ! -i br0",
+		"-d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::3]:80 ! -i br0",
+	)
+
+	if drifted, err := m.Reconcile([]*managedNetwork{network}, members, []*managedGroup{shrunk}); err != nil || drifted != 0 {
+		t.Fatalf("expected no drift, got %d (%v)", drifted, err)
+	}
+
+	// The same goes for a member changing its address (e.g. connected to another network first)
+	group = shrunk
+	moved := newTestContainer("c1", "fd00:1::11", newTestPort(80, "tcp", 8080))
+	moved.group = "web"
+	if err := m.ReplaceContainer(members[0], moved); err != nil {
+		t.Fatal(err)
+	}
+	readdressed := &managedGroup{name: "web", members: []*managedContainer{moved, members[2]}}
+	if err := m.ReplaceGroup(group, readdressed); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableNat, ChainDocker,
+		"-i br0 -j RETURN",
+		"-m statistic --mode nth --every 2 --packet 0 -d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::11]:80 ! -i br0",
+		"-d 0/0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination [fd00:1::3]:80 ! -i br0",
+	)
+	if shrunk.owner() == readdressed.owner() {
+		t.Error("expected the owner of the group to change along with the address of a member")
+	}
+}
+
+// fakeConntrack records the conntrack deletions
+type fakeConntrack struct {
+	deleted []string
+}
+
+func (c *fakeConntrack) DeletePort(proto string, hostAddress net.IP, hostPort uint16, address net.IP, port uint16) error {
+	c.deleted = append(c.deleted, fmt.Sprintf("port %s [%s]:%d [%s]:%d", proto, hostAddress, hostPort, address, port))
+	return nil
+}
+
+func (c *fakeConntrack) DeleteAddress(address net.IP) error {
+	c.deleted = append(c.deleted, fmt.Sprintf("address %s", address))
+	return nil
+}
+
+func TestManagerConntrack(t *testing.T) {
+	conntrack := &fakeConntrack{}
+	m, err := NewManager(NewMemoryBackend(), conntrack, nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	network := newTestNetwork()
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	container := newTestContainer("c1", "fd00:1::2", newTestPort(443, "tcp", 443), newTestPort(53, "udp", 5353))
+	if err := m.ReplaceContainer(nil, container); err != nil {
+		t.Fatal(err)
+	}
+
+	replaced := newTestContainer("c1", "fd00:1::2", newTestPort(443, "tcp", 443))
+	if err := m.ReplaceContainer(container, replaced); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReplaceContainer(replaced, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"port udp [::]:5353 [fd00:1::2]:53",
+		"address fd00:1::2",
+		"port tcp [::]:443 [fd00:1::2]:443",
+	}
+	if !reflect.DeepEqual(conntrack.deleted, expected) {
+		t.Errorf("unexpected conntrack deletions:\n%s\nexpected:\n%s", strings.Join(conntrack.deleted, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// Routed endpoints are reached on the container port directly, so their flows are deleted by address and port
+	routed := newTestContainer("c2", "fd00:1::3", newTestPort(80, "tcp", 8080))
+	routed.endpoints[0].routed = true
+	if err := m.ReplaceContainer(nil, routed); err != nil {
+		t.Fatal(err)
+	}
+	conntrack.deleted = nil
+	if err := m.ReplaceContainer(routed, newTestContainer("c2", "fd00:1::3")); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"port tcp [fd00:1::3]:80 [fd00:1::3]:80"}; !reflect.DeepEqual(conntrack.deleted, expected) {
+		t.Errorf("unexpected conntrack deletions:\n%s\nexpected:\n%s", strings.Join(conntrack.deleted, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestManagerNPT(t *testing.T) {
+	m, b := newTestManager(t)
+
+	network := newTestNetwork()
+	_, network.nptPrefix, _ = net.ParseCIDR("2001:db8:1::/64")
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+
+	// All containers are reachable at their translated addresses, but only on their published ports
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j ACCEPT",
+		"! -i br0 -o br0 -j DROP",
+	)
+	assertChain(t, b, TableNat, ChainPrerouting,
+		"-d 2001:db8:1::/64 ! -i br0 -j NETMAP --to fd00:1::/64",
+		"-m addrtype --dst-type LOCAL -j DOCKER",
+	)
+	assertChain(t, b, TableNat, ChainPostrouting,
+		"-j DOCKER-IPV6NAT-SNAT",
+		"-o br0 -m addrtype --dst-type LOCAL -j MASQUERADE",
+		"-s fd00:1::/64 ! -o br0 -j NETMAP --to 2001:db8:1::/64",
+	)
+}
+
+func TestManagerGatewayModes(t *testing.T) {
+	m, b := newTestManager(t)
+
+	// nat-unprotected accepts incoming traffic to all ports instead of dropping it
+	network := newTestNetwork()
+	network.mode = GatewayModeNATUnprotected
+	if err := m.ReplaceNetwork(nil, network); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j ACCEPT",
+	)
+	assertChain(t, b, TableFilter, ChainDocker,
+		"! -i br0 -o br0 -j ACCEPT",
+	)
+
+	protected := newTestNetwork()
+	if err := m.ReplaceNetwork(network, protected); err != nil {
+		t.Fatal(err)
+	}
+	assertChain(t, b, TableFilter, ChainForward,
+		"-j DOCKER-USER",
+		"-j DOCKER-ISOLATION-STAGE-1",
+		"-o br0 -j DOCKER",
+		"-o br0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"-i br0 ! -o br0 -j ACCEPT",
+		"-i br0 -o br0 -j ACCEPT",
+		"! -i br0 -o br0 -j DROP",
+	)
+	assertChain(t, b, TableFilter, ChainDocker)
+}
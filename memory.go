@@ -0,0 +1,202 @@
+package dockeripv6nat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// builtinTableChains are the chains that exist in a fresh ip(6)tables setup
+var builtinTableChains = []TableChain{
+	{TableFilter, ChainInput},
+	{TableFilter, ChainForward},
+	{TableFilter, ChainOutput},
+	{TableNat, ChainPrerouting},
+	{TableNat, ChainInput},
+	{TableNat, ChainOutput},
+	{TableNat, ChainPostrouting},
+}
+
+// builtinTargets are the targets that can be jumped to without them being a chain
+var builtinTargets = []string{
+	"ACCEPT",
+	"DROP",
+	"RETURN",
+	"REJECT",
+	"MASQUERADE",
+	"DNAT",
+	"SNAT",
+	"NETMAP",
+}
+
+// MemoryBackend is a Backend that keeps its chains in memory, modelling the ordering of their rules.
+// It doesn't touch the actual firewall, which makes it suitable for testing.
+type MemoryBackend struct {
+	chains map[TableChain][]*Rule
+}
+
+// NewMemoryBackend constructs a new MemoryBackend with only the builtin chains
+func NewMemoryBackend() *MemoryBackend {
+	chains := make(map[TableChain][]*Rule)
+	for _, tc := range builtinTableChains {
+		chains[tc] = make([]*Rule, 0)
+	}
+
+	return &MemoryBackend{
+		chains: chains,
+	}
+}
+
+func (b *MemoryBackend) index(r *Rule) (int, error) {
+	rules, exists := b.chains[r.tc]
+	if !exists {
+		return -1, fmt.Errorf("chain %s does not exist in table %s", r.tc.chain, r.tc.table)
+	}
+
+	for index, rule := range rules {
+		if r.Equal(rule) {
+			return index, nil
+		}
+	}
+
+	return -1, nil
+}
+
+func (b *MemoryBackend) isReferenced(tc TableChain) bool {
+	for other, rules := range b.chains {
+		if other.table != tc.table {
+			continue
+		}
+		for _, rule := range rules {
+			if rule.target() == string(tc.chain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// EnsureChain creates the given chain if it doesn't exist yet, optionally clearing it
+func (b *MemoryBackend) EnsureChain(tc TableChain, clear bool) error {
+	if _, exists := b.chains[tc]; !exists || clear {
+		b.chains[tc] = make([]*Rule, 0)
+	}
+
+	return nil
+}
+
+// RemoveChain clears and deletes the given chain
+func (b *MemoryBackend) RemoveChain(tc TableChain) error {
+	if _, exists := b.chains[tc]; !exists {
+		return fmt.Errorf("chain %s does not exist in table %s", tc.chain, tc.table)
+	}
+
+	for _, builtin := range builtinTableChains {
+		if tc == builtin {
+			return fmt.Errorf("cannot remove builtin chain %s in table %s", tc.chain, tc.table)
+		}
+	}
+
+	if b.isReferenced(tc) {
+		return fmt.Errorf("chain %s in table %s is still referenced", tc.chain, tc.table)
+	}
+
+	delete(b.chains, tc)
+	return nil
+}
+
+// List returns the rules in the given chain, in order
+func (b *MemoryBackend) List(tc TableChain) ([]*Rule, error) {
+	rules, exists := b.chains[tc]
+	if !exists {
+		return nil, fmt.Errorf("chain %s does not exist in table %s", tc.chain, tc.table)
+	}
+
+	return append([]*Rule(nil), rules...), nil
+}
+
+// ListCounters returns the rules in the given chain along with their counters, which are always 0
+func (b *MemoryBackend) ListCounters(tc TableChain) ([]RuleCounters, error) {
+	rules, err := b.List(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make([]RuleCounters, len(rules))
+	for index, rule := range rules {
+		counters[index].Rule = rule
+	}
+
+	return counters, nil
+}
+
+// Exists checks if the given rule exists
+func (b *MemoryBackend) Exists(r *Rule) (bool, error) {
+	index, err := b.index(r)
+	return index >= 0, err
+}
+
+// Insert adds the given rule at the given (1-based) position of its chain
+func (b *MemoryBackend) Insert(r *Rule, position int) error {
+	rules, exists := b.chains[r.tc]
+	if !exists {
+		return fmt.Errorf("chain %s does not exist in table %s", r.tc.chain, r.tc.table)
+	}
+
+	if position < 1 || position > len(rules)+1 {
+		return fmt.Errorf("invalid position %d for chain %s in table %s", position, r.tc.chain, r.tc.table)
+	}
+
+	if target := r.target(); target != "" && !contains(builtinTargets, target) {
+		if _, exists := b.chains[TableChain{r.tc.table, Chain(target)}]; !exists {
+			return fmt.Errorf("target chain %s does not exist in table %s", target, r.tc.table)
+		}
+	}
+
+	rules = append(rules, nil)
+	copy(rules[position:], rules[position-1:])
+	rules[position-1] = r
+	b.chains[r.tc] = rules
+	return nil
+}
+
+// Delete removes the given rule from its chain
+func (b *MemoryBackend) Delete(r *Rule) error {
+	index, err := b.index(r)
+	if err != nil {
+		return err
+	}
+
+	if index < 0 {
+		return fmt.Errorf("rule does not exist in chain %s in table %s: %s", r.tc.chain, r.tc.table, strings.Join(r.spec, " "))
+	}
+
+	b.chains[r.tc] = append(b.chains[r.tc][:index], b.chains[r.tc][index+1:]...)
+	return nil
+}
+
+// Apply performs all changes of the Transaction on a copy of the chains, only keeping it if all changes succeed
+func (b *MemoryBackend) Apply(tx Transaction) error {
+	chains := make(map[TableChain][]*Rule, len(b.chains))
+	for tc, rules := range b.chains {
+		chains[tc] = append([]*Rule(nil), rules...)
+	}
+	scratch := &MemoryBackend{
+		chains: chains,
+	}
+
+	for _, change := range tx {
+		var err error
+		if change.Delete {
+			err = scratch.Delete(change.Rule)
+		} else {
+			err = scratch.Insert(change.Rule, change.Position)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	b.chains = scratch.chains
+	return nil
+}
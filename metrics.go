@@ -0,0 +1,354 @@
+package dockeripv6nat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventDurationBuckets are the upper bounds (in seconds) of the event processing duration histogram
+var eventDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects the counters exposed on the /metrics endpoint, in the Prometheus text format.
+// A nil *Metrics can be used to disable collection.
+type Metrics struct {
+	mutex               sync.Mutex
+	reconnects          uint64
+	regenerates         uint64
+	eventDurationCounts []uint64
+	eventDurationSum    float64
+	eventCount          uint64
+	backendCalls        map[string]*backendCallMetrics
+}
+
+type backendCallMetrics struct {
+	count       uint64
+	errors      uint64
+	durationSum float64
+}
+
+// PortCounters holds the packet and byte counters of a published port
+type PortCounters struct {
+	Container string
+	Network   string
+	Proto     string
+	Port      uint16
+	Packets   uint64
+	Bytes     uint64
+}
+
+// NewMetrics constructs a new Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		eventDurationCounts: make([]uint64, len(eventDurationBuckets)),
+		backendCalls:        make(map[string]*backendCallMetrics),
+	}
+}
+
+// Reconnected counts a reconnect to the docker daemon
+func (m *Metrics) Reconnected() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reconnects++
+}
+
+// Regenerated counts a regenerate of the state
+func (m *Metrics) Regenerated() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.regenerates++
+}
+
+// ObserveEvent records the processing duration of a docker event
+func (m *Metrics) ObserveEvent(duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seconds := duration.Seconds()
+	for index, bound := range eventDurationBuckets {
+		if seconds <= bound {
+			m.eventDurationCounts[index]++
+		}
+	}
+	m.eventDurationSum += seconds
+	m.eventCount++
+}
+
+// ObserveBackendCall records a call to the firewall backend
+func (m *Metrics) ObserveBackendCall(operation string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	call, exists := m.backendCalls[operation]
+	if !exists {
+		call = &backendCallMetrics{}
+		m.backendCalls[operation] = call
+	}
+	call.count++
+	if err != nil {
+		call.errors++
+	}
+	call.durationSum += duration.Seconds()
+}
+
+// WriteMetrics writes all metrics (including the ones gathered from the State) in the Prometheus text format
+func (m *Metrics) WriteMetrics(w io.Writer, state *State) error {
+	networks := state.Networks()
+	containers := state.Containers()
+	ports, rules := 0, 0
+	for _, network := range networks {
+		rules += len(network.Rules)
+	}
+	for _, container := range containers {
+		for _, endpoint := range container.Endpoints {
+			ports += len(endpoint.Ports)
+		}
+		rules += len(container.Rules)
+	}
+
+	writeMetric(w, "ipv6nat_networks", "gauge", "Number of managed networks.")
+	writeSample(w, "ipv6nat_networks", nil, float64(len(networks)))
+	writeMetric(w, "ipv6nat_containers", "gauge", "Number of managed containers.")
+	writeSample(w, "ipv6nat_containers", nil, float64(len(containers)))
+	writeMetric(w, "ipv6nat_ports", "gauge", "Number of published ports.")
+	writeSample(w, "ipv6nat_ports", nil, float64(ports))
+	writeMetric(w, "ipv6nat_rules", "gauge", "Number of rules for the managed networks and containers.")
+	writeSample(w, "ipv6nat_rules", nil, float64(rules))
+
+	m.mutex.Lock()
+	writeMetric(w, "ipv6nat_docker_reconnects_total", "counter", "Number of reconnects to the docker daemon.")
+	writeSample(w, "ipv6nat_docker_reconnects_total", nil, float64(m.reconnects))
+	writeMetric(w, "ipv6nat_regenerates_total", "counter", "Number of full regenerates of the state.")
+	writeSample(w, "ipv6nat_regenerates_total", nil, float64(m.regenerates))
+
+	writeMetric(w, "ipv6nat_event_duration_seconds", "histogram", "Processing duration of docker events.")
+	for index, bound := range eventDurationBuckets {
+		writeSample(w, "ipv6nat_event_duration_seconds_bucket", []string{"le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(m.eventDurationCounts[index]))
+	}
+	writeSample(w, "ipv6nat_event_duration_seconds_bucket", []string{"le", "+Inf"}, float64(m.eventCount))
+	writeSample(w, "ipv6nat_event_duration_seconds_sum", nil, m.eventDurationSum)
+	writeSample(w, "ipv6nat_event_duration_seconds_count", nil, float64(m.eventCount))
+
+	operations := make([]string, 0, len(m.backendCalls))
+	for operation := range m.backendCalls {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	writeMetric(w, "ipv6nat_firewall_calls_total", "counter", "Number of calls to the firewall backend.")
+	for _, operation := range operations {
+		writeSample(w, "ipv6nat_firewall_calls_total", []string{"operation", operation}, float64(m.backendCalls[operation].count))
+	}
+	writeMetric(w, "ipv6nat_firewall_errors_total", "counter", "Number of failed calls to the firewall backend.")
+	for _, operation := range operations {
+		writeSample(w, "ipv6nat_firewall_errors_total", []string{"operation", operation}, float64(m.backendCalls[operation].errors))
+	}
+	writeMetric(w, "ipv6nat_firewall_call_duration_seconds", "summary", "Duration of calls to the firewall backend.")
+	for _, operation := range operations {
+		call := m.backendCalls[operation]
+		writeSample(w, "ipv6nat_firewall_call_duration_seconds_sum", []string{"operation", operation}, call.durationSum)
+		writeSample(w, "ipv6nat_firewall_call_duration_seconds_count", []string{"operation", operation}, float64(call.count))
+	}
+	m.mutex.Unlock()
+
+	portCounters, err := state.PortCounters()
+	if err != nil {
+		return err
+	}
+
+	writeMetric(w, "ipv6nat_port_packets_total", "counter", "Number of packets forwarded to a published port.")
+	for _, counter := range portCounters {
+		writeSample(w, "ipv6nat_port_packets_total", counter.labels(), float64(counter.Packets))
+	}
+	writeMetric(w, "ipv6nat_port_bytes_total", "counter", "Number of bytes forwarded to a published port.")
+	for _, counter := range portCounters {
+		writeSample(w, "ipv6nat_port_bytes_total", counter.labels(), float64(counter.Bytes))
+	}
+
+	return nil
+}
+
+func (pc *PortCounters) labels() []string {
+	return []string{"container", pc.Container, "network", pc.Network, "proto", pc.Proto, "port", strconv.Itoa(int(pc.Port))}
+}
+
+// PortCounters returns the counters of each published (container) port, as read from the filter DOCKER chain
+func (s *State) PortCounters() ([]PortCounters, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	counters, err := s.manager.fw.Counters(TableChain{TableFilter, ChainDocker})
+	if err != nil {
+		return nil, err
+	}
+
+	portCounters := make([]PortCounters, 0)
+	for _, container := range s.containers {
+		seen := make(map[string]bool)
+		for _, endpoint := range container.endpoints {
+			for _, port := range endpoint.ports {
+				// Sum the counters of all ACCEPT rules of the port (one per allowed source prefix).
+				portCounter := PortCounters{
+					Container: container.name,
+					Network:   endpoint.network,
+					Proto:     port.proto,
+					Port:      port.port,
+				}
+				found := false
+				for _, rule := range *getRulesForPort(&port, &endpoint, container.group != "", s.manager.hairpinMode).Tag(container.owner()) {
+					comment := rule.comment()
+					if rule.tc.table != TableFilter || rule.tc.chain != ChainDocker || seen[comment] {
+						continue
+					}
+					seen[comment] = true
+					found = true
+
+					portCounter.Packets += counters[comment].Packets
+					portCounter.Bytes += counters[comment].Bytes
+				}
+				if found {
+					portCounters = append(portCounters, portCounter)
+				}
+			}
+		}
+	}
+
+	sort.Slice(portCounters, func(i, j int) bool {
+		a, b := portCounters[i], portCounters[j]
+		if a.Container != b.Container {
+			return a.Container < b.Container
+		}
+		if a.Network != b.Network {
+			return a.Network < b.Network
+		}
+		if a.Proto != b.Proto {
+			return a.Proto < b.Proto
+		}
+		return a.Port < b.Port
+	})
+
+	return portCounters, nil
+}
+
+func writeMetric(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(w io.Writer, name string, labels []string, value float64) {
+	pairs := make([]string, 0, len(labels)/2)
+	for index := 0; index+1 < len(labels); index += 2 {
+		pairs = append(pairs, labels[index]+"="+strconv.Quote(labels[index+1]))
+	}
+
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// MetricsBackend is a Backend that records all calls to another Backend in the Metrics
+type MetricsBackend struct {
+	backend Backend
+	metrics *Metrics
+}
+
+// NewMetricsBackend constructs a new MetricsBackend on top of the given Backend
+func NewMetricsBackend(backend Backend, metrics *Metrics) *MetricsBackend {
+	return &MetricsBackend{
+		backend: backend,
+		metrics: metrics,
+	}
+}
+
+func (b *MetricsBackend) observe(operation string, start time.Time, err error) {
+	b.metrics.ObserveBackendCall(operation, time.Since(start), err)
+}
+
+// EnsureChain creates the given chain if it doesn't exist yet, optionally clearing it
+func (b *MetricsBackend) EnsureChain(tc TableChain, clear bool) error {
+	start := time.Now()
+	err := b.backend.EnsureChain(tc, clear)
+	b.observe("ensure_chain", start, err)
+	return err
+}
+
+// RemoveChain clears and deletes the given chain
+func (b *MetricsBackend) RemoveChain(tc TableChain) error {
+	start := time.Now()
+	err := b.backend.RemoveChain(tc)
+	b.observe("remove_chain", start, err)
+	return err
+}
+
+// List returns the rules in the given chain, in order
+func (b *MetricsBackend) List(tc TableChain) ([]*Rule, error) {
+	start := time.Now()
+	rules, err := b.backend.List(tc)
+	b.observe("list", start, err)
+	return rules, err
+}
+
+// ListCounters returns the rules in the given chain along with their counters, in order
+func (b *MetricsBackend) ListCounters(tc TableChain) ([]RuleCounters, error) {
+	backend, ok := b.backend.(CountingBackend)
+	if !ok {
+		return nil, errors.New("firewall backend does not support counters")
+	}
+
+	start := time.Now()
+	counters, err := backend.ListCounters(tc)
+	b.observe("list_counters", start, err)
+	return counters, err
+}
+
+// Exists checks if the given rule exists
+func (b *MetricsBackend) Exists(r *Rule) (bool, error) {
+	start := time.Now()
+	exists, err := b.backend.Exists(r)
+	b.observe("exists", start, err)
+	return exists, err
+}
+
+// Insert adds the given rule at the given (1-based) position of its chain
+func (b *MetricsBackend) Insert(r *Rule, position int) error {
+	start := time.Now()
+	err := b.backend.Insert(r, position)
+	b.observe("insert", start, err)
+	return err
+}
+
+// Delete removes the given rule from its chain
+func (b *MetricsBackend) Delete(r *Rule) error {
+	start := time.Now()
+	err := b.backend.Delete(r)
+	b.observe("delete", start, err)
+	return err
+}
+
+// Apply performs all changes of the Transaction, leaving the firewall untouched if any of them fails
+func (b *MetricsBackend) Apply(tx Transaction) error {
+	start := time.Now()
+	err := b.backend.Apply(tx)
+	b.observe("apply", start, err)
+	return err
+}
@@ -0,0 +1,672 @@
+package dockeripv6nat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// nftTableName is the name of the ip6 table owned by docker-ipv6nat when using the nftables backend
+const nftTableName = "ipv6nat"
+
+// rtnLocal is the RTN_LOCAL route type, as used by the addrtype match
+const rtnLocal = 2
+
+// nftBaseChains maps the builtin ip(6)tables chains we use to base chains of our own nftables table
+var nftBaseChains = map[TableChain]nftables.Chain{
+	{TableFilter, ChainForward}: {
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	},
+	{TableNat, ChainPrerouting}: {
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	},
+	{TableNat, ChainOutput}: {
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityNATDest,
+	},
+	{TableNat, ChainPostrouting}: {
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	},
+}
+
+// nftProtocols maps the protocol names used in rule specs to their IP protocol numbers
+var nftProtocols = map[string]byte{
+	"tcp":  6,
+	"udp":  17,
+	"sctp": 132,
+}
+
+// nftCtStates maps the conntrack states used in rule specs to their nftables bits
+var nftCtStates = map[string]uint32{
+	"INVALID":     expr.CtStateBitINVALID,
+	"ESTABLISHED": expr.CtStateBitESTABLISHED,
+	"RELATED":     expr.CtStateBitRELATED,
+	"NEW":         expr.CtStateBitNEW,
+	"UNTRACKED":   expr.CtStateBitUNTRACKED,
+}
+
+// NFTablesBackend is the Backend using a native nftables table (over netlink).
+// Every ip(6)tables table/chain combination is mapped to a chain named "<table>-<chain>" in the ip6 table "ipv6nat".
+// Rules are identified by their comment, which is the ownership comment of the rule (or the rule spec if untagged).
+type NFTablesBackend struct {
+	conn  *nftables.Conn
+	table *nftables.Table
+}
+
+// NewNFTablesBackend constructs a new NFTablesBackend, creating the ipv6nat table and its base chains if needed
+func NewNFTablesBackend() (*NFTablesBackend, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &NFTablesBackend{
+		conn: conn,
+		table: &nftables.Table{
+			Family: nftables.TableFamilyIPv6,
+			Name:   nftTableName,
+		},
+	}
+
+	conn.AddTable(b.table)
+	for tc := range nftBaseChains {
+		conn.AddChain(b.chain(tc))
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func nftChainName(tc TableChain) string {
+	return string(tc.table) + "-" + string(tc.chain)
+}
+
+func (b *NFTablesBackend) chain(tc TableChain) *nftables.Chain {
+	chain := nftBaseChains[tc]
+	chain.Name = nftChainName(tc)
+	chain.Table = b.table
+	return &chain
+}
+
+func (b *NFTablesBackend) find(r *Rule) (*nftables.Rule, error) {
+	rules, err := b.conn.GetRules(b.table, b.chain(r.tc))
+	if err != nil {
+		return nil, err
+	}
+
+	if index := nftRuleIndex(rules, r); index >= 0 {
+		return rules[index], nil
+	}
+
+	return nil, nil
+}
+
+// nftComment returns the comment used to identify the rule in nftables
+func nftComment(r *Rule) string {
+	if comment := r.comment(); comment != "" {
+		return comment
+	}
+
+	return strings.Join(r.spec, " ")
+}
+
+func nftRuleIndex(rules []*nftables.Rule, r *Rule) int {
+	key := nftComment(r)
+	for index, rule := range rules {
+		if comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment); ok && comment == key {
+			return index
+		}
+	}
+
+	return -1
+}
+
+func (b *NFTablesBackend) newRule(r *Rule) (*nftables.Rule, error) {
+	exprs, err := nftExprs(r.tc, r.spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nftables.Rule{
+		Table:    b.table,
+		Chain:    b.chain(r.tc),
+		Exprs:    exprs,
+		UserData: userdata.AppendString(nil, userdata.TypeComment, nftComment(r)),
+	}, nil
+}
+
+// EnsureChain creates the given chain if it doesn't exist yet, optionally clearing it
+func (b *NFTablesBackend) EnsureChain(tc TableChain, clear bool) error {
+	chain := b.chain(tc)
+	b.conn.AddChain(chain)
+	if clear {
+		b.conn.FlushChain(chain)
+	}
+
+	return b.conn.Flush()
+}
+
+// RemoveChain clears and deletes the given chain
+func (b *NFTablesBackend) RemoveChain(tc TableChain) error {
+	chain := b.chain(tc)
+	b.conn.FlushChain(chain)
+	b.conn.DelChain(chain)
+	return b.conn.Flush()
+}
+
+// List returns the rules in the given chain, in order.
+// Rules not created by docker-ipv6nat (without a comment) are returned with an empty spec,
+// tagged rules are returned with only their ownership comment as spec.
+func (b *NFTablesBackend) List(tc TableChain) ([]*Rule, error) {
+	nftRules, err := b.conn.GetRules(b.table, b.chain(tc))
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*Rule, len(nftRules))
+	for index, rule := range nftRules {
+		rules[index] = nftListedRule(tc, rule)
+	}
+
+	return rules, nil
+}
+
+// ListCounters returns the rules in the given chain along with their counters, in order
+func (b *NFTablesBackend) ListCounters(tc TableChain) ([]RuleCounters, error) {
+	nftRules, err := b.conn.GetRules(b.table, b.chain(tc))
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make([]RuleCounters, len(nftRules))
+	for index, rule := range nftRules {
+		counters[index].Rule = nftListedRule(tc, rule)
+		for _, e := range rule.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				counters[index].Packets = counter.Packets
+				counters[index].Bytes = counter.Bytes
+			}
+		}
+	}
+
+	return counters, nil
+}
+
+func nftListedRule(tc TableChain, rule *nftables.Rule) *Rule {
+	comment, _ := userdata.GetString(rule.UserData, userdata.TypeComment)
+	if strings.HasPrefix(comment, commentPrefix+" ") {
+		return NewRule(tc.table, tc.chain, "-m", "comment", "--comment", comment)
+	}
+
+	return NewRule(tc.table, tc.chain, strings.Fields(comment)...)
+}
+
+// Exists checks if the given rule exists
+func (b *NFTablesBackend) Exists(r *Rule) (bool, error) {
+	rule, err := b.find(r)
+	if err != nil {
+		return false, err
+	}
+
+	return rule != nil, nil
+}
+
+// Insert adds the given rule at the given (1-based) position of its chain
+func (b *NFTablesBackend) Insert(r *Rule, position int) error {
+	rule, err := b.newRule(r)
+	if err != nil {
+		return err
+	}
+
+	rules, err := b.conn.GetRules(b.table, rule.Chain)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case position < 1 || position > len(rules)+1:
+		return fmt.Errorf("invalid position %d for chain %s", position, rule.Chain.Name)
+	case position == 1:
+		b.conn.InsertRule(rule)
+	default:
+		rule.Position = rules[position-2].Handle
+		b.conn.AddRule(rule)
+	}
+
+	return b.conn.Flush()
+}
+
+// Delete removes the given rule from its chain
+func (b *NFTablesBackend) Delete(r *Rule) error {
+	rule, err := b.find(r)
+	if err != nil {
+		return err
+	}
+
+	if rule == nil {
+		return fmt.Errorf("rule does not exist in chain %s: %s", nftChainName(r.tc), strings.Join(r.spec, " "))
+	}
+
+	if err := b.conn.DelRule(rule); err != nil {
+		return err
+	}
+
+	return b.conn.Flush()
+}
+
+// Apply performs all changes of the Transaction in a single (atomic) netlink batch
+func (b *NFTablesBackend) Apply(tx Transaction) error {
+	// Keep track of the rule order after each change, where rules added within this batch don't have a handle yet.
+	chains := make(map[TableChain][]*nftables.Rule)
+	ops := make([]func(), 0, len(tx))
+
+	for _, change := range tx {
+		tc := change.Rule.tc
+		rules, loaded := chains[tc]
+		if !loaded {
+			var err error
+			if rules, err = b.conn.GetRules(b.table, b.chain(tc)); err != nil {
+				return err
+			}
+		}
+
+		if change.Delete {
+			index := nftRuleIndex(rules, change.Rule)
+			if index < 0 || rules[index].Handle == 0 {
+				return fmt.Errorf("rule does not exist in chain %s: %s", nftChainName(tc), strings.Join(change.Rule.spec, " "))
+			}
+			rule := rules[index]
+			ops = append(ops, func() { b.conn.DelRule(rule) })
+			rules = append(rules[:index:index], rules[index+1:]...)
+		} else {
+			rule, err := b.newRule(change.Rule)
+			if err != nil {
+				return err
+			}
+
+			position := change.Position
+			switch {
+			case position < 1 || position > len(rules)+1:
+				return fmt.Errorf("invalid position %d for chain %s", position, nftChainName(tc))
+			case position == 1:
+				ops = append(ops, func() { b.conn.InsertRule(rule) })
+			case rules[position-2].Handle != 0:
+				rule.Position = rules[position-2].Handle
+				ops = append(ops, func() { b.conn.AddRule(rule) })
+			case position == len(rules)+1:
+				ops = append(ops, func() { b.conn.AddRule(rule) })
+			case rules[position-1].Handle != 0:
+				rule.Position = rules[position-1].Handle
+				ops = append(ops, func() { b.conn.InsertRule(rule) })
+			default:
+				return fmt.Errorf("unable to position rule in chain %s: %s", nftChainName(tc), strings.Join(change.Rule.spec, " "))
+			}
+
+			rules = append(rules[:position-1:position-1], append([]*nftables.Rule{rule}, rules[position-1:]...)...)
+		}
+
+		chains[tc] = rules
+	}
+
+	// Only queue the messages once the whole transaction is known to be valid.
+	for _, op := range ops {
+		op()
+	}
+
+	return b.conn.Flush()
+}
+
+// nftExprs translates an ip6tables rule spec into the equivalent nftables expressions
+func nftExprs(tc TableChain, spec []string) ([]expr.Any, error) {
+	exprs := make([]expr.Any, 0, len(spec))
+	target := ""
+	toDestination := ""
+	toSource := ""
+	to := ""
+	every := uint32(0)
+	negate := false
+
+	for index := 0; index < len(spec); index++ {
+		option := spec[index]
+		if option == "!" {
+			negate = true
+			continue
+		}
+
+		if index+1 >= len(spec) {
+			return nil, fmt.Errorf("missing value for %s", option)
+		}
+		index++
+		value := spec[index]
+
+		negated := negate
+		negate = false
+
+		op := expr.CmpOpEq
+		if negated {
+			op = expr.CmpOpNeq
+		}
+
+		switch option {
+		case "-i":
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: op, Register: 1, Data: nftInterfaceName(value)})
+		case "-o":
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				&expr.Cmp{Op: op, Register: 1, Data: nftInterfaceName(value)})
+		case "-s", "-d":
+			offset := uint32(8)
+			if option == "-d" {
+				offset = 24
+			}
+			addressExprs, err := nftAddressExprs(offset, value, op)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, addressExprs...)
+		case "-p":
+			proto, exists := nftProtocols[value]
+			if !exists {
+				return nil, fmt.Errorf("unsupported protocol %s", value)
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: op, Register: 1, Data: []byte{proto}})
+		case "-m":
+			// Matches are recognized by their options, the module name itself is irrelevant.
+		case "--comment":
+			// Comments are stored as rule userdata instead.
+		case "--dport":
+			port, err := parsePort(value)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: op, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)})
+		case "--ctstate":
+			var mask uint32
+			for _, state := range strings.Split(value, ",") {
+				bit, exists := nftCtStates[state]
+				if !exists {
+					return nil, fmt.Errorf("unsupported conntrack state %s", state)
+				}
+				mask |= bit
+			}
+			// Invert the comparison, since we're checking the masked state against 0.
+			op = expr.CmpOpNeq
+			if negated {
+				op = expr.CmpOpEq
+			}
+			exprs = append(exprs,
+				&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            4,
+					Mask:           binaryutil.NativeEndian.PutUint32(mask),
+					Xor:            binaryutil.NativeEndian.PutUint32(0),
+				},
+				&expr.Cmp{Op: op, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)})
+		case "--mode":
+			if value != "nth" {
+				return nil, fmt.Errorf("unsupported statistic mode %s", value)
+			}
+		case "--every":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("invalid value for --every: %s", value)
+			}
+			every = uint32(n)
+		case "--packet":
+			// The statistic nth mode is an incremental number generator (with a counter per rule as well).
+			packet, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || every == 0 || uint32(packet) >= every {
+				return nil, fmt.Errorf("invalid value for --packet: %s", value)
+			}
+			exprs = append(exprs,
+				&expr.Numgen{Register: 1, Modulus: every, Type: unix.NFT_NG_INCREMENTAL},
+				&expr.Cmp{Op: op, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(packet))})
+		case "--dst-type":
+			if value != "LOCAL" {
+				return nil, fmt.Errorf("unsupported address type %s", value)
+			}
+			exprs = append(exprs,
+				&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+				&expr.Cmp{Op: op, Register: 1, Data: binaryutil.NativeEndian.PutUint32(rtnLocal)})
+		case "-j":
+			target = value
+		case "--to-destination":
+			toDestination = value
+		case "--to-source":
+			toSource = value
+		case "--to":
+			to = value
+		default:
+			return nil, fmt.Errorf("unsupported option %s", option)
+		}
+	}
+
+	exprs = append(exprs, &expr.Counter{})
+
+	switch target {
+	case "":
+	case "ACCEPT":
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	case "DROP":
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	case "RETURN":
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+	case "MASQUERADE":
+		exprs = append(exprs, &expr.Masq{})
+	case "DNAT":
+		natExprs, err := nftNATExprs(expr.NATTypeDestNAT, toDestination)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, natExprs...)
+	case "SNAT":
+		natExprs, err := nftNATExprs(expr.NATTypeSourceNAT, toSource)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, natExprs...)
+	case "NETMAP":
+		natExprs, err := nftNetmapExprs(tc, to)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, natExprs...)
+	default:
+		exprs = append(exprs, &expr.Verdict{
+			Kind:  expr.VerdictJump,
+			Chain: nftChainName(TableChain{tc.table, Chain(target)}),
+		})
+	}
+
+	return exprs, nil
+}
+
+func nftInterfaceName(name string) []byte {
+	data := make([]byte, 16)
+	copy(data, name+"\x00")
+	return data
+}
+
+func nftAddressExprs(offset uint32, value string, op expr.CmpOp) ([]expr.Any, error) {
+	if value == "0/0" {
+		return nil, nil
+	}
+
+	var subnet *net.IPNet
+	if strings.Contains(value, "/") {
+		var err error
+		if _, subnet, err = net.ParseCIDR(value); err != nil {
+			return nil, err
+		}
+	} else {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", value)
+		}
+		subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+
+	ones, _ := subnet.Mask.Size()
+	if ones == 0 {
+		return nil, nil
+	}
+
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: net.IPv6len},
+	}
+	if ones < 128 {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            net.IPv6len,
+			Mask:           subnet.Mask,
+			Xor:            make([]byte, net.IPv6len),
+		})
+	}
+
+	return append(exprs, &expr.Cmp{Op: op, Register: 1, Data: subnet.IP.To16()}), nil
+}
+
+// nftNATExprs translates the --to-destination / --to-source of DNAT / SNAT, which is either an address (range) or an
+// address with a port (in brackets)
+func nftNATExprs(natType expr.NATType, value string) ([]expr.Any, error) {
+	host, port := value, ""
+	if strings.HasPrefix(value, "[") {
+		var err error
+		if host, port, err = net.SplitHostPort(value); err != nil {
+			return nil, err
+		}
+	}
+
+	first, last := host, ""
+	if index := strings.Index(host, "-"); index >= 0 {
+		first, last = host[:index], host[index+1:]
+	}
+
+	ip := net.ParseIP(first)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid NAT address %s", value)
+	}
+
+	nat := &expr.NAT{
+		Type:       natType,
+		Family:     uint32(nftables.TableFamilyIPv6),
+		RegAddrMin: 1,
+	}
+	exprs := []expr.Any{&expr.Immediate{Register: 1, Data: ip.To16()}}
+
+	if last != "" {
+		lastIP := net.ParseIP(last)
+		if lastIP == nil {
+			return nil, fmt.Errorf("invalid NAT address %s", value)
+		}
+		exprs = append(exprs, &expr.Immediate{Register: 2, Data: lastIP.To16()})
+		nat.RegAddrMax = 2
+	}
+
+	if port != "" {
+		portNumber, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		// The kernel marks the port range as specified by itself when a register is given for it.
+		exprs = append(exprs, &expr.Immediate{Register: 3, Data: binaryutil.BigEndian.PutUint16(uint16(portNumber))})
+		nat.RegProtoMin = 3
+	}
+
+	return append(exprs, nat), nil
+}
+
+// nftNetmapExprs translates NETMAP to prefix NAT, which maps the source address in POSTROUTING and the destination
+// address elsewhere (just like NETMAP does)
+func nftNetmapExprs(tc TableChain, prefix string) ([]expr.Any, error) {
+	_, subnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	last := make(net.IP, net.IPv6len)
+	for index := range last {
+		last[index] = subnet.IP[index] | ^subnet.Mask[index]
+	}
+
+	natType := expr.NATTypeDestNAT
+	if tc.chain == ChainPostrouting {
+		natType = expr.NATTypeSourceNAT
+	}
+
+	return []expr.Any{
+		&expr.Immediate{Register: 1, Data: subnet.IP.To16()},
+		&expr.Immediate{Register: 2, Data: last},
+		&expr.NAT{
+			Type:       natType,
+			Family:     uint32(nftables.TableFamilyIPv6),
+			RegAddrMin: 1,
+			RegAddrMax: 2,
+			Prefix:     true,
+		},
+	}, nil
+}
+
+func detectHairpinModeNFTables() (bool, error) {
+	// Inspect the IPv4 nat table as created by Docker (through iptables-nft) to detect --userland-proxy=false.
+
+	conn, err := nftables.New()
+	if err != nil {
+		return false, err
+	}
+
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: TableNat}
+	rules, err := conn.GetRules(table, &nftables.Chain{Name: ChainOutput, Table: table})
+	if err != nil {
+		return false, err
+	}
+
+	for _, rule := range rules {
+		jumpsToDocker := false
+		excludesLoopback := false
+		for _, e := range rule.Exprs {
+			switch e := e.(type) {
+			case *expr.Verdict:
+				jumpsToDocker = e.Kind == expr.VerdictJump && e.Chain == ChainDocker
+			case *expr.Cmp:
+				// The "! -d 127.0.0.0/8" match is a comparison against the first byte of the destination address.
+				if e.Op == expr.CmpOpNeq && len(e.Data) > 0 && e.Data[0] == 127 {
+					excludesLoopback = true
+				}
+			}
+		}
+
+		if jumpsToDocker {
+			return !excludesLoopback, nil
+		}
+	}
+
+	return false, errors.New("unable to detect hairpin mode (is the docker daemon running?)")
+}
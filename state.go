@@ -1,44 +1,54 @@
 package dockeripv6nat
 
 import (
+	"bytes"
+	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/fsouza/go-dockerclient"
 )
 
-// State keeps track of the current Docker containers and networks to apply relative updates to the manager
+// State keeps track of the current Docker containers and networks to apply relative updates to the manager.
+// It's safe for concurrent use, e.g. by the Watcher and the StatusServer.
 type State struct {
-	manager    *Manager
-	networks   map[string]*managedNetwork
-	containers map[string]*managedContainer
+	mutex        sync.RWMutex
+	manager      *Manager
+	subnetFilter *SubnetFilter
+	optIn        bool
+	healthAware  bool
+	limits       *PortLimits
+	networks     map[string]*managedNetwork
+	containers   map[string]*managedContainer
 }
 
-// fc00::/7, Unique Local IPv6 Unicast Addresses, see RFC 4193
-var ulaCIDR = net.IPNet{
-	IP:   net.ParseIP("fc00::"),
-	Mask: net.CIDRMask(7, 128),
-}
-
-// NewState constructs a new state
-func NewState(debug bool) (*State, error) {
-	manager, err := NewManager(debug)
-	if err != nil {
-		return nil, err
-	}
-
+// NewState constructs a new state, managing the networks with a subnet matching the SubnetFilter. With optIn, only
+// containers labelled with ipv6nat.enable=true are published. With healthAware, containers with a healthcheck are only
+// published while healthy. Ports are published with the given default limits, or without any limits if nil (e.g. if
+// the firewall backend doesn't support them).
+func NewState(manager *Manager, subnetFilter *SubnetFilter, optIn bool, healthAware bool, limits *PortLimits) *State {
 	return &State{
-		manager:    manager,
-		networks:   make(map[string]*managedNetwork),
-		containers: make(map[string]*managedContainer),
-	}, nil
+		manager:      manager,
+		subnetFilter: subnetFilter,
+		optIn:        optIn,
+		healthAware:  healthAware,
+		limits:       limits,
+		networks:     make(map[string]*managedNetwork),
+		containers:   make(map[string]*managedContainer),
+	}
 }
 
 // Cleanup resets the state
 func (s *State) Cleanup() error {
-	s.RemoveMissingContainers([]string{})
-	s.RemoveMissingNetworks([]string{})
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.removeMissingContainers([]string{})
+	s.removeMissingNetworks([]string{})
 
 	if err := s.manager.Cleanup(); err != nil {
 		return err
@@ -47,11 +57,58 @@ func (s *State) Cleanup() error {
 	return nil
 }
 
+// Reconcile repairs any drift between the firewall and the current state, returning the number of drifted rules
+func (s *State) Reconcile() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.manager.Reconcile(s.getKnownNetworks(), s.getKnownContainers(), s.getKnownGroups())
+}
+
 // RemoveMissingNetworks removes any of the given networks, if they don't exist
 func (s *State) RemoveMissingNetworks(networkIDs []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.removeMissingNetworks(networkIDs)
+}
+
+// RemoveMissingContainers removes any of the given containers if they don't exist
+func (s *State) RemoveMissingContainers(containerIDs []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.removeMissingContainers(containerIDs)
+}
+
+// UpdateNetwork applies a network, which can add, remove or update it
+func (s *State) UpdateNetwork(id string, network *docker.Network) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.updateNetwork(id, network)
+}
+
+// UpdateContainer applies a container, which can add, remove or update it
+func (s *State) UpdateContainer(id string, container *docker.Container) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.updateContainer(id, container)
+}
+
+// UpdateIPSets applies a (new) IPSetConfig, which is used to publish the containers from then on
+func (s *State) UpdateIPSets(config *IPSetConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.manager.UpdateIPSets(config)
+}
+
+func (s *State) removeMissingNetworks(networkIDs []string) error {
 	for id := range s.networks {
 		if !contains(networkIDs, id) {
-			if err := s.UpdateNetwork(id, nil); err != nil {
+			if err := s.updateNetwork(id, nil); err != nil {
 				return err
 			}
 		}
@@ -60,11 +117,10 @@ func (s *State) RemoveMissingNetworks(networkIDs []string) error {
 	return nil
 }
 
-// RemoveMissingContainers removes any of the given containers if they don't exist
-func (s *State) RemoveMissingContainers(containerIDs []string) error {
+func (s *State) removeMissingContainers(containerIDs []string) error {
 	for id := range s.containers {
 		if !contains(containerIDs, id) {
-			if err := s.UpdateContainer(id, nil); err != nil {
+			if err := s.updateContainer(id, nil); err != nil {
 				return err
 			}
 		}
@@ -73,8 +129,7 @@ func (s *State) RemoveMissingContainers(containerIDs []string) error {
 	return nil
 }
 
-// UpdateNetwork applies a network, which can add, remove or update it
-func (s *State) UpdateNetwork(id string, network *docker.Network) error {
+func (s *State) updateNetwork(id string, network *docker.Network) error {
 	oldNetwork := s.networks[id]
 	newNetwork := s.parseNetwork(network)
 
@@ -93,11 +148,24 @@ func (s *State) UpdateNetwork(id string, network *docker.Network) error {
 	return nil
 }
 
-// UpdateContainer applies a container, which can add, remove or update it
-func (s *State) UpdateContainer(id string, container *docker.Container) error {
+func (s *State) updateContainer(id string, container *docker.Container) error {
 	oldContainer := s.containers[id]
 	newContainer := s.parseContainer(container)
 
+	// Any group the container leaves or joins is rebalanced as well.
+	groupNames := make([]string, 0, 2)
+	if oldContainer != nil && oldContainer.group != "" {
+		groupNames = append(groupNames, oldContainer.group)
+	}
+	if newContainer != nil && newContainer.group != "" && !contains(groupNames, newContainer.group) {
+		groupNames = append(groupNames, newContainer.group)
+	}
+
+	oldGroups := make([]*managedGroup, len(groupNames))
+	for index, name := range groupNames {
+		oldGroups[index] = s.getGroup(name)
+	}
+
 	if oldContainer != nil || newContainer != nil {
 		if err := s.manager.ReplaceContainer(oldContainer, newContainer); err != nil {
 			return err
@@ -110,6 +178,12 @@ func (s *State) UpdateContainer(id string, container *docker.Container) error {
 		s.containers[id] = newContainer
 	}
 
+	for index, name := range groupNames {
+		if err := s.manager.ReplaceGroup(oldGroups[index], s.getGroup(name)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -126,6 +200,7 @@ func (s *State) parseNetwork(network *docker.Network) *managedNetwork {
 
 	n := managedNetwork{
 		id:         network.ID,
+		name:       network.Name,
 		bridge:     "br-" + network.ID[:12],
 		icc:        true,
 		masquerade: true,
@@ -133,12 +208,36 @@ func (s *State) parseNetwork(network *docker.Network) *managedNetwork {
 		binding:    net.ParseIP("::"),
 	}
 
+	gatewayMode, hasGatewayMode := network.Options["com.docker.network.bridge.gateway_mode_ipv6"]
+	switch gatewayMode {
+	case GatewayModeNAT, GatewayModeNATUnprotected, GatewayModeRouted, GatewayModeIsolated:
+	default:
+		if hasGatewayMode {
+			log.Printf("invalid value for com.docker.network.bridge.gateway_mode_ipv6 (network %s)", network.ID)
+			hasGatewayMode = false
+		}
+	}
+
+	// The subnet filter can be overridden per network (by option or label), to either always or never manage it.
+	// An explicit gateway mode also opts the network in, e.g. a routed network with a global subnet.
+	enabled, hasEnabled := lookupBool(network.Options, "com.docker.network.bridge.enable_ipv6nat", "network", network.ID)
+	if b, exists := lookupBool(network.Labels, "ipv6nat.enable", "network", network.ID); exists {
+		enabled, hasEnabled = b, true
+	}
+	if !hasEnabled && hasGatewayMode {
+		enabled, hasEnabled = true, true
+	}
+
+	if hasEnabled && !enabled {
+		return nil
+	}
+
 	for _, config := range network.IPAM.Config {
 		_, subnet, err := net.ParseCIDR(config.Subnet)
-		if err != nil {
+		if err != nil || subnet.IP.To4() != nil {
 			continue
 		}
-		if ulaCIDR.Contains(subnet.IP) {
+		if hasEnabled || s.subnetFilter.Matches(subnet) {
 			n.subnet = *subnet
 			break
 		}
@@ -148,6 +247,13 @@ func (s *State) parseNetwork(network *docker.Network) *managedNetwork {
 		return nil
 	}
 
+	n.mode = GatewayModeNAT
+	if hasGatewayMode {
+		n.mode = gatewayMode
+	} else if s.subnetFilter.Routed(&n.subnet) {
+		n.mode = GatewayModeRouted
+	}
+
 	for key, value := range network.Options {
 		switch key {
 		case "com.docker.network.bridge.name":
@@ -173,28 +279,69 @@ func (s *State) parseNetwork(network *docker.Network) *managedNetwork {
 				break
 			}
 			n.binding = ip
+		case "com.docker.network.bridge.npt_prefix_ipv6":
+			_, prefix, err := net.ParseCIDR(value)
+			if err != nil || prefix.IP.To4() != nil {
+				log.Printf("invalid value for com.docker.network.bridge.npt_prefix_ipv6 (network %s)", network.ID)
+				break
+			}
+			n.nptPrefix = prefix
+		case "com.docker.network.bridge.snat_ipv6":
+			first, last, err := parseAddressRange(value)
+			if err != nil {
+				log.Printf("invalid value for com.docker.network.bridge.snat_ipv6 (network %s)", network.ID)
+				break
+			}
+			n.snatFirst, n.snatLast = first, last
 		}
 	}
 
+	if n.nptPrefix != nil && n.nptPrefix.Mask.String() != n.subnet.Mask.String() {
+		log.Printf("prefix length of com.docker.network.bridge.npt_prefix_ipv6 does not match subnet %s (network %s)", n.subnet.String(), network.ID)
+		n.nptPrefix = nil
+	}
+
+	if n.mode == GatewayModeRouted && (n.nptPrefix != nil || n.snatFirst != nil) {
+		log.Printf("ignoring npt_prefix_ipv6 and snat_ipv6 in routed mode (network %s)", network.ID)
+		n.nptPrefix, n.snatFirst, n.snatLast = nil, nil, nil
+	}
+
 	return &n
 }
 
-func (s *State) findFirstKnownNetwork(networks map[string]docker.ContainerNetwork) (*managedNetwork, net.IP) {
+// containerNetwork is a managed network a container is attached to, along with its address on that network
+type containerNetwork struct {
+	network *managedNetwork
+	address net.IP
+}
+
+// findKnownNetworks returns the managed networks a container can be published on, sorted by name (and ID) to make the
+// choice between them deterministic
+func (s *State) findKnownNetworks(networks map[string]docker.ContainerNetwork) []containerNetwork {
+	known := make([]containerNetwork, 0, len(networks))
 	for _, network := range networks {
 		ip := net.ParseIP(network.GlobalIPv6Address)
-		if !ulaCIDR.Contains(ip) {
+		if ip == nil {
 			continue
 		}
 
 		n, found := s.networks[network.NetworkID]
-		if !found || n.internal {
+		if !found || n.isolated() || !n.subnet.Contains(ip) {
 			continue
 		}
 
-		return n, ip
+		known = append(known, containerNetwork{n, ip})
 	}
 
-	return nil, nil
+	sort.Slice(known, func(i, j int) bool {
+		a, b := known[i].network, known[j].network
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.id < b.id
+	})
+
+	return known
 }
 
 func (s *State) getKnownNetworks() []*managedNetwork {
@@ -208,22 +355,195 @@ func (s *State) getKnownNetworks() []*managedNetwork {
 	return networks
 }
 
+func (s *State) getKnownContainers() []*managedContainer {
+	containers := make([]*managedContainer, len(s.containers))
+	index := 0
+	for _, container := range s.containers {
+		containers[index] = container
+		index++
+	}
+
+	return containers
+}
+
+// getGroup returns the load-balancing group with the given name, or nil if it has no members
+func (s *State) getGroup(name string) *managedGroup {
+	members := make([]*managedContainer, 0)
+	for _, container := range s.containers {
+		if container.group == name {
+			members = append(members, container)
+		}
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].id < members[j].id
+	})
+
+	return &managedGroup{
+		name:    name,
+		members: members,
+	}
+}
+
+func (s *State) getKnownGroups() []*managedGroup {
+	names := make([]string, 0)
+	for _, container := range s.containers {
+		if container.group != "" && !contains(names, container.group) {
+			names = append(names, container.group)
+		}
+	}
+
+	groups := make([]*managedGroup, len(names))
+	for index, name := range names {
+		groups[index] = s.getGroup(name)
+	}
+
+	return groups
+}
+
 func (s *State) parseContainer(container *docker.Container) *managedContainer {
 	if container == nil {
 		return nil
 	}
 
-	network, containerAddress := s.findFirstKnownNetwork(container.NetworkSettings.Networks)
-	if network == nil {
+	var labels map[string]string
+	if container.Config != nil {
+		labels = container.Config.Labels
+	}
+
+	// In opt-in mode, only containers labelled with ipv6nat.enable=true are published, otherwise all but the ones
+	// labelled with ipv6nat.enable=false.
+	if enabled, exists := lookupBool(labels, "ipv6nat.enable", "container", container.ID); !enabled && (exists || s.optIn) {
 		return nil
 	}
 
-	if network.internal {
+	// Members of a group share their host ports with the others, so they're always health-aware.
+	group := labels["ipv6nat.lb-group"]
+
+	// Without a healthcheck, the status is empty; otherwise wait until the container is healthy (again).
+	if (s.healthAware || group != "") && container.State.Health.Status != "" && container.State.Health.Status != "healthy" {
 		return nil
 	}
 
+	networks := s.findKnownNetworks(container.NetworkSettings.Networks)
+	if len(networks) == 0 {
+		return nil
+	}
+
+	publishAll, _ := lookupBool(labels, "ipv6nat.publish-all-networks", "container", container.ID)
+
+	var publicAddress net.IP
+	if value, exists := labels["ipv6nat.public-address"]; exists {
+		publicAddress = net.ParseIP(value)
+		if publicAddress == nil || publicAddress.To4() != nil || publicAddress.IsUnspecified() {
+			// Don't publish the container at all, rather than on a shared address.
+			log.Printf("invalid value for ipv6nat.public-address (container %s)", container.ID)
+			return nil
+		}
+	}
+
+	// By default, only publish on the first network (by name), unless another one is picked or all of them are.
+	if value, exists := labels["ipv6nat.network"]; exists {
+		networks = selectNetwork(networks, value)
+		if len(networks) == 0 {
+			log.Printf("network %s is not managed (container %s)", value, container.ID)
+			return nil
+		}
+	} else if !publishAll {
+		networks = networks[:1]
+	}
+
+	endpoints := make([]managedEndpoint, 0, len(networks))
+	for _, network := range networks {
+		routed := network.network.mode == GatewayModeRouted
+		ports := s.parsePortBindings(container, labels, network.network)
+
+		// With a public address, the container gets it to itself: all ports are published on it, and its outgoing
+		// traffic is translated to it as well (even without any ports). Routed containers have their own address.
+		var endpointAddress net.IP
+		if publicAddress != nil && !routed {
+			endpointAddress = publicAddress
+			for index := range ports {
+				ports[index].hostAddress = publicAddress
+			}
+		}
+
+		if len(ports) == 0 && endpointAddress == nil {
+			continue
+		}
+
+		endpoints = append(endpoints, managedEndpoint{
+			network:       network.network.name,
+			bridge:        network.network.bridge,
+			address:       network.address,
+			publicAddress: endpointAddress,
+			routed:        routed,
+			ports:         ports,
+		})
+	}
+
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	return &managedContainer{
+		id:        container.ID,
+		name:      strings.TrimPrefix(container.Name, "/"),
+		group:     group,
+		endpoints: endpoints,
+	}
+}
+
+// selectNetwork returns only the network with the given name or ID
+func selectNetwork(networks []containerNetwork, nameOrID string) []containerNetwork {
+	for _, network := range networks {
+		if network.network.name == nameOrID || network.network.id == nameOrID {
+			return []containerNetwork{network}
+		}
+	}
+
+	return nil
+}
+
+// parsePortBindings returns the ports of the container to publish on the given network
+func (s *State) parsePortBindings(container *docker.Container, labels map[string]string, network *managedNetwork) []managedPort {
+	portBindings := container.HostConfig.PortBindings
+
+	// The ipv6nat.publish label adds IPv6-only bindings, replacing Docker's bindings of the same container port.
+	if value, exists := labels["ipv6nat.publish"]; exists {
+		publishBindings := make(map[docker.Port][]docker.PortBinding)
+		for _, mapping := range strings.Split(value, ",") {
+			mapping = strings.TrimSpace(mapping)
+			if mapping == "" {
+				continue
+			}
+
+			port, binding, err := parsePublishMapping(mapping)
+			if err != nil {
+				log.Printf("%v in ipv6nat.publish (container %s)", err, container.ID)
+				continue
+			}
+			publishBindings[port] = append(publishBindings[port], binding)
+		}
+
+		if len(publishBindings) > 0 {
+			merged := make(map[docker.Port][]docker.PortBinding, len(portBindings)+len(publishBindings))
+			for port, bindings := range portBindings {
+				merged[port] = bindings
+			}
+			for port, bindings := range publishBindings {
+				merged[port] = bindings
+			}
+			portBindings = merged
+		}
+	}
+
 	ports := make([]managedPort, 0)
-	for port, bindings := range container.HostConfig.PortBindings {
+	for port, bindings := range portBindings {
 		proto := port.Proto()
 		containerPort, err := parsePort(port.Port())
 		if err != nil {
@@ -231,6 +551,19 @@ func (s *State) parseContainer(container *docker.Container) *managedContainer {
 			continue
 		}
 
+		allowFrom, allowSets, blockSets, err := s.parseSourceFilters(labels, port.Port(), proto)
+		if err != nil {
+			// Don't publish the port at all, rather than to everyone.
+			log.Printf("%v for port %s of container %s", err, port, container.ID)
+			continue
+		}
+
+		limits, err := s.parseLimits(labels, port.Port(), proto)
+		if err != nil {
+			log.Printf("%v for port %s of container %s", err, port, container.ID)
+			continue
+		}
+
 		for _, binding := range bindings {
 			hostAddress := network.binding
 
@@ -255,20 +588,209 @@ func (s *State) parseContainer(container *docker.Container) *managedContainer {
 				proto:       proto,
 				hostAddress: hostAddress,
 				hostPort:    hostPort,
+				allowFrom:   allowFrom,
+				allowSets:   allowSets,
+				blockSets:   blockSets,
+				limits:      limits,
 			})
 		}
 	}
 
-	if len(ports) == 0 {
-		return nil
+	return ports
+}
+
+// parsePublishMapping parses a mapping of the ipv6nat.publish label, like [2001:db8::10]:443:8443/tcp or 443:8443 (on
+// the host address of the network, over TCP)
+func parsePublishMapping(value string) (docker.Port, docker.PortBinding, error) {
+	var binding docker.PortBinding
+
+	rest := value
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]:")
+		if end < 0 {
+			return "", binding, fmt.Errorf("invalid mapping %s", value)
+		}
+
+		ip := net.ParseIP(rest[1:end])
+		if ip == nil || ip.To4() != nil {
+			return "", binding, fmt.Errorf("invalid IPv6 address %s", rest[1:end])
+		}
+
+		binding.HostIP = ip.String()
+		rest = rest[end+2:]
 	}
 
-	return &managedContainer{
-		id:      container.ID,
-		address: containerAddress,
-		bridge:  network.bridge,
-		ports:   ports,
+	proto := "tcp"
+	if index := strings.Index(rest, "/"); index >= 0 {
+		proto = rest[index+1:]
+		rest = rest[:index]
+	}
+
+	if proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return "", binding, fmt.Errorf("invalid protocol %s", proto)
+	}
+
+	parts := strings.Split(rest, ":")
+	if len(parts) != 2 {
+		return "", binding, fmt.Errorf("invalid mapping %s", value)
+	}
+
+	ports := make([]string, len(parts))
+	for index, part := range parts {
+		port, err := parsePort(part)
+		if err != nil || port == 0 {
+			return "", binding, fmt.Errorf("invalid port %s", part)
+		}
+		ports[index] = strconv.Itoa(int(port))
+	}
+
+	binding.HostPort = ports[0]
+	return docker.Port(ports[1] + "/" + proto), binding, nil
+}
+
+// lookupPortLabel returns the key and value of the most specific label for a port: <key>.<port>/<proto>, <key>.<port>
+// or <key> itself
+func lookupPortLabel(labels map[string]string, key, port, proto string) (string, string, bool) {
+	for _, portKey := range []string{key + "." + port + "/" + proto, key + "." + port, key} {
+		if value, exists := labels[portKey]; exists {
+			return portKey, value, true
+		}
+	}
+
+	return "", "", false
+}
+
+// parseSourceFilters returns the allowed source prefixes and sets, and the blocked source sets for a port
+func (s *State) parseSourceFilters(labels map[string]string, port, proto string) ([]*net.IPNet, []string, []string, error) {
+	allowFrom, err := parseAllowFrom(labels, port, proto)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	allowSets, err := s.parseIPSets(labels, "ipv6nat.allow-from-set", port, proto)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	blockSets, err := s.parseIPSets(labels, "ipv6nat.block-from-set", port, proto)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return allowFrom, allowSets, blockSets, nil
+}
+
+// parseLimits returns the limits for a port: the defaults, overridden by the ipv6nat.rate-limit and ipv6nat.conn-limit
+// labels
+func (s *State) parseLimits(labels map[string]string, port, proto string) (PortLimits, error) {
+	if s.limits == nil {
+		for _, key := range []string{"ipv6nat.rate-limit", "ipv6nat.conn-limit"} {
+			if key, _, exists := lookupPortLabel(labels, key, port, proto); exists {
+				return PortLimits{}, fmt.Errorf("unsupported label %s (limits require the ip6tables backend)", key)
+			}
+		}
+		return PortLimits{}, nil
+	}
+
+	limits := *s.limits
+	if key, value, exists := lookupPortLabel(labels, "ipv6nat.rate-limit", port, proto); exists {
+		if err := limits.setRate(value); err != nil {
+			return PortLimits{}, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+
+	if key, value, exists := lookupPortLabel(labels, "ipv6nat.conn-limit", port, proto); exists {
+		if err := limits.setConnections(value); err != nil {
+			return PortLimits{}, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+
+	return limits, nil
+}
+
+// parseAllowFrom returns the source prefixes a port is published to, from the ipv6nat.allow-from labels. Returns nil to
+// allow any source.
+func parseAllowFrom(labels map[string]string, port, proto string) ([]*net.IPNet, error) {
+	key, value, exists := lookupPortLabel(labels, "ipv6nat.allow-from", port, proto)
+	if !exists {
+		return nil, nil
+	}
+
+	prefixes, err := parsePrefixes(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %v", key, err)
 	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("invalid value for %s: no prefixes", key)
+	}
+
+	return prefixes, nil
+}
+
+// parseIPSets returns the names of the sets in the given labels for a port, which must all exist
+func (s *State) parseIPSets(labels map[string]string, key, port, proto string) ([]string, error) {
+	key, value, exists := lookupPortLabel(labels, key, port, proto)
+	if !exists {
+		return nil, nil
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !s.manager.ipSetConfig.Has(name) {
+			return nil, fmt.Errorf("invalid value for %s: unknown ipset %s", key, name)
+		}
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("invalid value for %s: no ipsets", key)
+	}
+
+	return names, nil
+}
+
+// parseAddressRange parses an IPv6 address or address range (first-last), returning nil as last for a single address
+func parseAddressRange(value string) (net.IP, net.IP, error) {
+	parts := strings.SplitN(value, "-", 2)
+	addresses := make([]net.IP, len(parts))
+	for index, part := range parts {
+		ip := net.ParseIP(strings.TrimSpace(part))
+		if ip == nil || ip.To4() != nil {
+			return nil, nil, fmt.Errorf("invalid IPv6 address %s", part)
+		}
+		addresses[index] = ip
+	}
+
+	if len(addresses) == 1 {
+		return addresses[0], nil, nil
+	}
+
+	if bytes.Compare(addresses[0], addresses[1]) > 0 {
+		return nil, nil, fmt.Errorf("invalid IPv6 address range %s", value)
+	}
+
+	return addresses[0], addresses[1], nil
+}
+
+// lookupBool parses the boolean value for the given key (an option or label of a network or container), returning false
+// if it doesn't exist or is invalid
+func lookupBool(values map[string]string, key, kind, id string) (bool, bool) {
+	value, exists := values[key]
+	if !exists {
+		return false, false
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid value for %s (%s %s)", key, kind, id)
+		return false, false
+	}
+
+	return b, true
 }
 
 func parsePort(rawPort string) (uint16, error) {
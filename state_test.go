@@ -0,0 +1,210 @@
+package dockeripv6nat
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const testNetworkID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func newTestState(t *testing.T, optIn bool) *State {
+	t.Helper()
+
+	m, _ := newTestManager(t)
+	filter, err := NewSubnetFilter("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewState(m, filter, optIn, false, nil)
+}
+
+func newTestDockerNetwork(subnet string, labels map[string]string) *docker.Network {
+	return &docker.Network{
+		ID:     testNetworkID,
+		Name:   "net",
+		Driver: "bridge",
+		IPAM: docker.IPAMOptions{
+			Config: []docker.IPAMConfig{{Subnet: "172.18.0.0/16"}, {Subnet: subnet}},
+		},
+		Options: map[string]string{},
+		Labels:  labels,
+	}
+}
+
+func newTestDockerContainer(labels map[string]string) *docker.Container {
+	return &docker.Container{
+		ID:     "c1",
+		Name:   "/web",
+		Config: &docker.Config{Labels: labels},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]docker.ContainerNetwork{
+				"net": {NetworkID: testNetworkID, GlobalIPv6Address: "fd00:1::2"},
+			},
+		},
+		HostConfig: &docker.HostConfig{
+			PortBindings: map[docker.Port][]docker.PortBinding{
+				"80/tcp": {{HostPort: "8080"}},
+			},
+		},
+	}
+}
+
+func TestParsePublishMapping(t *testing.T) {
+	tests := []struct {
+		value   string
+		port    docker.Port
+		binding docker.PortBinding
+		valid   bool
+	}{
+		{"443:8443", "8443/tcp", docker.PortBinding{HostPort: "443"}, true},
+		{"53:5353/udp", "5353/udp", docker.PortBinding{HostPort: "53"}, true},
+		{"3868:3868/sctp", "3868/sctp", docker.PortBinding{HostPort: "3868"}, true},
+		{"[2001:db8::10]:443:8443/tcp", "8443/tcp", docker.PortBinding{HostIP: "2001:db8::10", HostPort: "443"}, true},
+		{"[2001:0db8:0::10]:443:8443", "8443/tcp", docker.PortBinding{HostIP: "2001:db8::10", HostPort: "443"}, true},
+		{"[::]:80:80/udp", "80/udp", docker.PortBinding{HostIP: "::", HostPort: "80"}, true},
+		{"080:0080", "80/tcp", docker.PortBinding{HostPort: "80"}, true},
+		{"443:8443/", "", docker.PortBinding{}, false},
+		{"443:8443/icmp", "", docker.PortBinding{}, false},
+		{"[192.0.2.10]:443:8443", "", docker.PortBinding{}, false},
+		{"[::ffff:192.0.2.10]:443:8443", "", docker.PortBinding{}, false},
+		{"192.0.2.10:443:8443", "", docker.PortBinding{}, false},
+		{"2001:db8::10:443:8443", "", docker.PortBinding{}, false},
+		{"[2001:db8::10:443:8443", "", docker.PortBinding{}, false},
+		{"[2001:db8::10]443:8443", "", docker.PortBinding{}, false},
+		{"0:8443", "", docker.PortBinding{}, false},
+		{"443:0", "", docker.PortBinding{}, false},
+		{"65536:443", "", docker.PortBinding{}, false},
+		{"443", "", docker.PortBinding{}, false},
+		{"443:", "", docker.PortBinding{}, false},
+		{"", "", docker.PortBinding{}, false},
+	}
+
+	for _, test := range tests {
+		port, binding, err := parsePublishMapping(test.value)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.value, err)
+			continue
+		}
+		if port != test.port || binding != test.binding {
+			t.Errorf("%q: expected %s %+v, got %s %+v", test.value, test.port, test.binding, port, binding)
+		}
+	}
+}
+
+func TestParseAddressRange(t *testing.T) {
+	tests := []struct {
+		value string
+		first string
+		last  string
+		valid bool
+	}{
+		{"2001:db8::10", "2001:db8::10", "", true},
+		{"2001:db8::10-2001:db8::1f", "2001:db8::10", "2001:db8::1f", true},
+		{"2001:db8::10 - 2001:db8::1f", "2001:db8::10", "2001:db8::1f", true},
+		{"2001:db8::10-2001:db8::10", "2001:db8::10", "2001:db8::10", true},
+		{"2001:db8::1f-2001:db8::10", "", "", false},
+		{"192.0.2.1", "", "", false},
+		{"2001:db8::10-192.0.2.1", "", "", false},
+		{"2001:db8::/64", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, test := range tests {
+		first, last, err := parseAddressRange(test.value)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.value, err)
+			continue
+		}
+		if !first.Equal(net.ParseIP(test.first)) || (test.last == "" && last != nil) || (test.last != "" && !last.Equal(net.ParseIP(test.last))) {
+			t.Errorf("%q: expected %s-%s, got %s-%s", test.value, test.first, test.last, first, last)
+		}
+	}
+}
+
+func TestParseNetworkLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnet  string
+		labels  map[string]string
+		options map[string]string
+		managed bool
+	}{
+		{"ula", "fd00:1::/64", nil, nil, true},
+		{"global", "2001:db8::/64", nil, nil, false},
+		{"disabled", "fd00:1::/64", map[string]string{"ipv6nat.enable": "false"}, nil, false},
+		{"enabled", "2001:db8::/64", map[string]string{"ipv6nat.enable": "true"}, nil, true},
+		{"invalid", "fd00:1::/64", map[string]string{"ipv6nat.enable": "maybe"}, nil, true},
+		{"label over option", "2001:db8::/64", map[string]string{"ipv6nat.enable": "true"},
+			map[string]string{"com.docker.network.bridge.enable_ipv6nat": "false"}, true},
+		{"option", "fd00:1::/64", nil, map[string]string{"com.docker.network.bridge.enable_ipv6nat": "false"}, false},
+		{"gateway mode", "2001:db8::/64", nil, map[string]string{"com.docker.network.bridge.gateway_mode_ipv6": "routed"}, true},
+		{"ipv4 only", "", map[string]string{"ipv6nat.enable": "true"}, nil, false},
+	}
+
+	s := newTestState(t, false)
+	for _, test := range tests {
+		network := newTestDockerNetwork(test.subnet, test.labels)
+		for key, value := range test.options {
+			network.Options[key] = value
+		}
+
+		n := s.parseNetwork(network)
+		if managed := n != nil; managed != test.managed {
+			t.Errorf("%s: expected managed %v, got %v", test.name, test.managed, managed)
+			continue
+		}
+		if n != nil && n.subnet.String() != test.subnet {
+			t.Errorf("%s: expected subnet %s, got %s", test.name, test.subnet, n.subnet.String())
+		}
+	}
+}
+
+func TestParseContainerLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		optIn     bool
+		labels    map[string]string
+		published bool
+	}{
+		{"default", false, nil, true},
+		{"disabled", false, map[string]string{"ipv6nat.enable": "false"}, false},
+		{"enabled", false, map[string]string{"ipv6nat.enable": "true"}, true},
+		{"invalid", false, map[string]string{"ipv6nat.enable": "maybe"}, true},
+		{"opt-in default", true, nil, false},
+		{"opt-in disabled", true, map[string]string{"ipv6nat.enable": "0"}, false},
+		{"opt-in enabled", true, map[string]string{"ipv6nat.enable": "1"}, true},
+		{"opt-in invalid", true, map[string]string{"ipv6nat.enable": "maybe"}, false},
+		{"unmanaged network", false, map[string]string{"ipv6nat.network": "other"}, false},
+		{"public address", false, map[string]string{"ipv6nat.public-address": "2001:db8::10"}, true},
+		{"ipv4 public address", false, map[string]string{"ipv6nat.public-address": "192.0.2.10"}, false},
+	}
+
+	for _, test := range tests {
+		s := newTestState(t, test.optIn)
+		s.networks[testNetworkID] = s.parseNetwork(newTestDockerNetwork("fd00:1::/64", nil))
+
+		c := s.parseContainer(newTestDockerContainer(test.labels))
+		if published := c != nil; published != test.published {
+			t.Errorf("%s: expected published %v, got %v", test.name, test.published, published)
+			continue
+		}
+		if c != nil && (c.name != "web" || len(c.endpoints) != 1 || len(c.endpoints[0].ports) != 1) {
+			t.Errorf("%s: unexpected container %+v", test.name, c)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package dockeripv6nat
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// NetworkStatus is the JSON representation of a managed network
+type NetworkStatus struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Bridge     string   `json:"bridge"`
+	Subnet     string   `json:"subnet"`
+	ICC        bool     `json:"icc"`
+	Masquerade bool     `json:"masquerade"`
+	Internal   bool     `json:"internal"`
+	Binding    string   `json:"binding"`
+	Mode       string   `json:"mode"`
+	NPTPrefix  string   `json:"nptPrefix,omitempty"`
+	SNAT       string   `json:"snat,omitempty"`
+	Rules      []string `json:"rules"`
+}
+
+// ContainerStatus is the JSON representation of a managed container
+type ContainerStatus struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Group     string           `json:"group,omitempty"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+	Rules     []string         `json:"rules"`
+}
+
+// EndpointStatus is the JSON representation of a network a managed container is published on
+type EndpointStatus struct {
+	Network       string       `json:"network"`
+	Bridge        string       `json:"bridge"`
+	Address       string       `json:"address"`
+	PublicAddress string       `json:"publicAddress,omitempty"`
+	Ports         []PortStatus `json:"ports"`
+}
+
+// PortStatus is the JSON representation of a published port of a managed container
+type PortStatus struct {
+	Port        uint16   `json:"port"`
+	Proto       string   `json:"proto"`
+	HostAddress string   `json:"hostAddress"`
+	HostPort    uint16   `json:"hostPort"`
+	AllowFrom   []string `json:"allowFrom,omitempty"`
+}
+
+// Networks returns the status of all managed networks, sorted by name
+func (s *State) Networks() []NetworkStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	networks := make([]NetworkStatus, 0, len(s.networks))
+	for _, network := range s.networks {
+		networks = append(networks, NetworkStatus{
+			ID:         network.id,
+			Name:       network.name,
+			Bridge:     network.bridge,
+			Subnet:     network.subnet.String(),
+			ICC:        network.icc,
+			Masquerade: network.masquerade,
+			Internal:   network.internal,
+			Binding:    network.binding.String(),
+			Mode:       network.mode,
+			NPTPrefix:  ipNetString(network.nptPrefix),
+			SNAT:       network.snatRange(),
+			Rules:      ruleStrings(getRulesForNetwork(network, s.manager.hairpinMode)),
+		})
+	}
+
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].Name < networks[j].Name
+	})
+
+	return networks
+}
+
+// Containers returns the status of all managed containers, sorted by name
+func (s *State) Containers() []ContainerStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	containers := make([]ContainerStatus, 0, len(s.containers))
+	for _, container := range s.containers {
+		endpoints := make([]EndpointStatus, len(container.endpoints))
+		for index, endpoint := range container.endpoints {
+			ports := make([]PortStatus, len(endpoint.ports))
+			for index, port := range endpoint.ports {
+				ports[index] = PortStatus{
+					Port:        port.port,
+					Proto:       port.proto,
+					HostAddress: port.hostAddress.String(),
+					HostPort:    port.hostPort,
+					AllowFrom:   prefixStrings(port.allowFrom),
+				}
+			}
+
+			endpoints[index] = EndpointStatus{
+				Network: endpoint.network,
+				Bridge:  endpoint.bridge,
+				Address: endpoint.address.String(),
+				Ports:   ports,
+			}
+			if endpoint.publicAddress != nil {
+				endpoints[index].PublicAddress = endpoint.publicAddress.String()
+			}
+		}
+
+		containers = append(containers, ContainerStatus{
+			ID:        container.id,
+			Name:      container.name,
+			Group:     container.group,
+			Endpoints: endpoints,
+			Rules:     ruleStrings(getRulesForContainer(container, s.manager.hairpinMode)),
+		})
+	}
+
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Name < containers[j].Name
+	})
+
+	return containers
+}
+
+func ipNetString(ipNet *net.IPNet) string {
+	if ipNet == nil {
+		return ""
+	}
+
+	return ipNet.String()
+}
+
+func prefixStrings(prefixes []*net.IPNet) []string {
+	if prefixes == nil {
+		return nil
+	}
+
+	strs := make([]string, len(prefixes))
+	for index, prefix := range prefixes {
+		strs[index] = prefix.String()
+	}
+
+	return strs
+}
+
+func ruleStrings(rules *Ruleset) []string {
+	strs := make([]string, len(*rules))
+	for index, rule := range *rules {
+		args := []string{"-t", string(rule.tc.table), "-A", string(rule.tc.chain)}
+		for _, arg := range rule.spec {
+			args = append(args, quoteRuleArg(arg))
+		}
+		strs[index] = strings.Join(args, " ")
+	}
+
+	return strs
+}
+
+// StatusServer serves the State as JSON over HTTP, on the following endpoints:
+//
+//	/networks, /networks/<id or name>
+//	/containers, /containers/<id or name>
+//	/metrics (if enabled)
+type StatusServer struct {
+	state    *State
+	metrics  *Metrics
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewStatusServer constructs a new StatusServer listening on the given address, which is either a TCP address
+// (host:port) or a unix socket (unix:/path/to/socket). Metrics are only served if not nil.
+func NewStatusServer(state *State, metrics *Metrics, address string) (*StatusServer, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+
+		// Remove a stale socket from a previous run.
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &StatusServer{
+		state:    state,
+		metrics:  metrics,
+		listener: listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", ss.handleNetworks)
+	mux.HandleFunc("/networks/", ss.handleNetworks)
+	mux.HandleFunc("/containers", ss.handleContainers)
+	mux.HandleFunc("/containers/", ss.handleContainers)
+	if metrics != nil {
+		mux.HandleFunc("/metrics", ss.handleMetrics)
+	}
+	ss.server = &http.Server{Handler: mux}
+
+	return ss, nil
+}
+
+// Serve handles requests until the StatusServer is closed
+func (ss *StatusServer) Serve() error {
+	if err := ss.server.Serve(ss.listener); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Close stops the StatusServer
+func (ss *StatusServer) Close() error {
+	return ss.server.Close()
+}
+
+func (ss *StatusServer) handleNetworks(w http.ResponseWriter, r *http.Request) {
+	networks := ss.state.Networks()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/networks"), "/")
+	if key == "" {
+		writeJSON(w, networks)
+		return
+	}
+
+	for _, network := range networks {
+		if network.ID == key || network.Name == key {
+			writeJSON(w, network)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+func (ss *StatusServer) handleContainers(w http.ResponseWriter, r *http.Request) {
+	containers := ss.state.Containers()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/containers"), "/")
+	if key == "" {
+		writeJSON(w, containers)
+		return
+	}
+
+	for _, container := range containers {
+		if container.ID == key || container.Name == key {
+			writeJSON(w, container)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+func (ss *StatusServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := ss.metrics.WriteMetrics(w, ss.state); err != nil {
+		log.Printf("unable to gather metrics: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
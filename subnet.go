@@ -0,0 +1,90 @@
+package dockeripv6nat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// fc00::/7, Unique Local IPv6 Unicast Addresses, see RFC 4193
+var ulaCIDR = net.IPNet{
+	IP:   net.ParseIP("fc00::"),
+	Mask: net.CIDRMask(7, 128),
+}
+
+// SubnetFilter decides which IPv6 subnets are managed, based on prefixes to include and exclude, and which of them are
+// routed (filtered only, without NAT)
+type SubnetFilter struct {
+	include []*net.IPNet
+	exclude []*net.IPNet
+	routed  []*net.IPNet
+}
+
+// NewSubnetFilter constructs a new SubnetFilter from comma-separated lists of prefixes.
+// Without any prefixes to include, only ULA subnets (fc00::/7) are included. Routed prefixes are always included.
+func NewSubnetFilter(include, exclude, routed string) (*SubnetFilter, error) {
+	includePrefixes, err := parsePrefixes(include)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(includePrefixes) == 0 {
+		includePrefixes = []*net.IPNet{&ulaCIDR}
+	}
+
+	excludePrefixes, err := parsePrefixes(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	routedPrefixes, err := parsePrefixes(routed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubnetFilter{
+		include: includePrefixes,
+		exclude: excludePrefixes,
+		routed:  routedPrefixes,
+	}, nil
+}
+
+// Matches checks if the subnet lies within one of the prefixes to include (or routed), but not within one to exclude
+func (f *SubnetFilter) Matches(subnet *net.IPNet) bool {
+	return (prefixesContain(f.include, subnet) || prefixesContain(f.routed, subnet)) && !prefixesContain(f.exclude, subnet)
+}
+
+// Routed checks if the subnet lies within one of the routed prefixes
+func (f *SubnetFilter) Routed(subnet *net.IPNet) bool {
+	return prefixesContain(f.routed, subnet)
+}
+
+func prefixesContain(prefixes []*net.IPNet, subnet *net.IPNet) bool {
+	subnetOnes, _ := subnet.Mask.Size()
+	for _, prefix := range prefixes {
+		prefixOnes, _ := prefix.Mask.Size()
+		if prefixOnes <= subnetOnes && prefix.Contains(subnet.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parsePrefixes(value string) ([]*net.IPNet, error) {
+	prefixes := make([]*net.IPNet, 0)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		_, prefix, err := net.ParseCIDR(field)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 prefix: %s", field)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,50 @@
+package dockeripv6nat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSubnetFilterMatches(t *testing.T) {
+	tests := []struct {
+		include  string
+		exclude  string
+		routed   string
+		subnet   string
+		matches  bool
+		isRouted bool
+	}{
+		{"", "", "", "fd00:1::/64", true, false},
+		{"", "", "", "2001:db8::/64", false, false},
+		{"2001:db8::/32", "", "", "2001:db8:1::/64", true, false},
+		{"2001:db8::/32", "", "", "fd00:1::/64", false, false},
+		{"2001:db8::/32", "", "", "2001:db8::/16", false, false},
+		{"2001:db8::/32, fd00::/8", "", "", "fd00:1::/64", true, false},
+		{"", "fd00:1::/48", "", "fd00:1::/64", false, false},
+		{"", "fd00:1::/48", "", "fd00:2::/64", true, false},
+		{"", "", "2001:db8::/32", "2001:db8:1::/64", true, true},
+		{"", "2001:db8:1::/48", "2001:db8::/32", "2001:db8:1::/64", false, true},
+	}
+
+	for _, test := range tests {
+		filter, err := NewSubnetFilter(test.include, test.exclude, test.routed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		if matches := filter.Matches(subnet); matches != test.matches {
+			t.Errorf("%s (include %q, exclude %q, routed %q): expected match %v, got %v", test.subnet, test.include,
+				test.exclude, test.routed, test.matches, matches)
+		}
+		if routed := filter.Routed(subnet); routed != test.isRouted {
+			t.Errorf("%s (routed %q): expected routed %v, got %v", test.subnet, test.routed, test.isRouted, routed)
+		}
+	}
+
+	for _, value := range []string{"192.0.2.0/24", "fd00::", "fd00::/129"} {
+		if _, err := NewSubnetFilter(value, "", ""); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,6 +15,9 @@ import (
 // RecoverableError wraps an error to signal the application does not need to crash
 type RecoverableError struct {
 	err error
+
+	// disconnected is set if the connection to the docker daemon was lost, so recovering means reconnecting
+	disconnected bool
 }
 
 func (re *RecoverableError) Error() string {
@@ -30,14 +34,23 @@ type Watcher struct {
 	eventChannel  chan *docker.APIEvents
 	signalChannel chan os.Signal
 	retry         bool
+	ipSetFile     string
+	metrics       *Metrics
+
+	reconcileInterval time.Duration
+	reconcileChannel  <-chan time.Time
 }
 
-// NewWatcher constructs a new watcher
-func NewWatcher(client *docker.Client, state *State, retry bool) *Watcher {
+// NewWatcher constructs a new watcher, which reconciles the firewall every reconcileInterval (if not 0) and reloads the
+// ipSetFile (if not empty) on every regenerate, e.g. after a SIGHUP. Metrics is optional (can be nil).
+func NewWatcher(client *docker.Client, state *State, retry bool, reconcileInterval time.Duration, ipSetFile string, metrics *Metrics) *Watcher {
 	return &Watcher{
-		client: client,
-		state:  state,
-		retry:  retry,
+		client:            client,
+		state:             state,
+		retry:             retry,
+		ipSetFile:         ipSetFile,
+		metrics:           metrics,
+		reconcileInterval: reconcileInterval,
 	}
 }
 
@@ -47,6 +60,12 @@ func (w *Watcher) Watch() error {
 	signal.Notify(w.signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL)
 	defer signal.Stop(w.signalChannel)
 
+	if w.reconcileInterval > 0 {
+		ticker := time.NewTicker(w.reconcileInterval)
+		defer ticker.Stop()
+		w.reconcileChannel = ticker.C
+	}
+
 	done := false
 	for !done {
 		if w.eventChannel == nil {
@@ -76,6 +95,9 @@ func (w *Watcher) attemptRecovery(err error) error {
 			w.eventChannel = nil
 		}
 		log.Printf("%v", errRecoverable.err)
+		if errRecoverable.disconnected {
+			w.metrics.Reconnected()
+		}
 		return nil
 	}
 
@@ -85,18 +107,23 @@ func (w *Watcher) attemptRecovery(err error) error {
 func (w *Watcher) setupListener() error {
 	// Always try a ping first
 	if err := w.client.Ping(); err != nil {
-		return &RecoverableError{err}
+		return &RecoverableError{err, true}
 	}
 
 	w.eventChannel = make(chan *docker.APIEvents, 1024)
 	if err := w.client.AddEventListener(w.eventChannel); err != nil {
-		return &RecoverableError{err}
+		return &RecoverableError{err, true}
 	}
 
 	if err := w.regenerate(); err != nil {
 		return err
 	}
 
+	// Clean up after the regenerate, e.g. rules adopted at startup that are no longer needed.
+	if err := w.reconcile(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -105,21 +132,32 @@ func (w *Watcher) processOnce() (bool, error) {
 	case <-time.After(retryInterval * time.Second):
 		if w.eventChannel != nil {
 			if err := w.client.Ping(); err != nil {
-				return false, &RecoverableError{err}
+				return false, &RecoverableError{err, true}
 			}
 		}
 	case event, ok := <-w.eventChannel:
 		if !ok {
-			return false, &RecoverableError{errors.New("docker daemon connection interrupted")}
+			return false, &RecoverableError{errors.New("docker daemon connection interrupted"), true}
 		}
-		if err := w.handleEvent(event); err != nil {
+		start := time.Now()
+		err := w.handleEvent(event)
+		w.metrics.ObserveEvent(time.Since(start))
+		if err != nil {
 			// Wrap in a RecoverableError so that a regenerate will be initiated.
-			return false, &RecoverableError{err}
+			return false, &RecoverableError{err, false}
+		}
+	case <-w.reconcileChannel:
+		// Only reconcile if the state is up-to-date, otherwise the next regenerate will take care of it.
+		if w.eventChannel != nil {
+			if err := w.reconcile(); err != nil {
+				// Wrap in a RecoverableError so that a regenerate will be initiated.
+				return false, &RecoverableError{err, false}
+			}
 		}
 	case sig := <-w.signalChannel:
 		if sig == syscall.SIGHUP {
 			// Return a RecoverableError so that a regenerate will be initiated.
-			return false, &RecoverableError{errors.New("received SIGHUP")}
+			return false, &RecoverableError{errors.New("received SIGHUP"), false}
 		}
 		return true, nil
 	}
@@ -127,10 +165,35 @@ func (w *Watcher) processOnce() (bool, error) {
 	return false, nil
 }
 
+func (w *Watcher) reconcile() error {
+	drifted, err := w.state.Reconcile()
+	if err != nil {
+		return err
+	}
+
+	if drifted > 0 {
+		log.Printf("repaired %d drifted rules", drifted)
+	}
+
+	return nil
+}
+
 func (w *Watcher) regenerate() error {
+	w.metrics.Regenerated()
+
+	if w.ipSetFile != "" {
+		// Keep using the current sets if the file has become invalid, rather than crashing.
+		config, err := LoadIPSetConfig(w.ipSetFile)
+		if err != nil {
+			log.Printf("unable to reload ipsets: %v", err)
+		} else if err := w.state.UpdateIPSets(config); err != nil {
+			return err
+		}
+	}
+
 	networks, err := w.client.ListNetworks()
 	if err != nil {
-		return &RecoverableError{err}
+		return &RecoverableError{err, false}
 	}
 
 	networkIDs := make([]string, len(networks))
@@ -143,7 +206,7 @@ func (w *Watcher) regenerate() error {
 
 	apiContainers, err := w.client.ListContainers(docker.ListContainersOptions{})
 	if err != nil {
-		return &RecoverableError{err}
+		return &RecoverableError{err, false}
 	}
 
 	containerIDs := make([]string, len(apiContainers))
@@ -154,7 +217,7 @@ func (w *Watcher) regenerate() error {
 			if _, match := err.(*docker.NoSuchContainer); match {
 				container = nil
 			} else {
-				return &RecoverableError{err}
+				return &RecoverableError{err, false}
 			}
 		}
 		if err := w.state.UpdateContainer(apiContainer.ID, container); err != nil {
@@ -174,6 +237,14 @@ func (w *Watcher) regenerate() error {
 }
 
 func (w *Watcher) handleEvent(event *docker.APIEvents) error {
+	if event.Type == "container" {
+		// Actions look like "health_status: healthy", and are only sent when the status changes.
+		if strings.HasPrefix(event.Action, "health_status") {
+			return w.updateContainer(event.Actor.ID)
+		}
+		return nil
+	}
+
 	if event.Type != "network" {
 		return nil
 	}
@@ -187,7 +258,7 @@ func (w *Watcher) handleEvent(event *docker.APIEvents) error {
 			if _, match := err.(*docker.NoSuchNetwork); match {
 				network = nil
 			} else {
-				return &RecoverableError{err}
+				return &RecoverableError{err, false}
 			}
 		}
 		if err := w.state.UpdateNetwork(networkID, network); err != nil {
@@ -198,19 +269,23 @@ func (w *Watcher) handleEvent(event *docker.APIEvents) error {
 			return err
 		}
 	case "connect", "disconnect":
-		containerID := event.Actor.Attributes["container"]
-		container, err := w.client.InspectContainer(containerID)
-		if err != nil {
-			if _, match := err.(*docker.NoSuchContainer); match {
-				container = nil
-			} else {
-				return &RecoverableError{err}
-			}
-		}
-		if err := w.state.UpdateContainer(containerID, container); err != nil {
+		if err := w.updateContainer(event.Actor.Attributes["container"]); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+func (w *Watcher) updateContainer(containerID string) error {
+	container, err := w.client.InspectContainer(containerID)
+	if err != nil {
+		if _, match := err.(*docker.NoSuchContainer); match {
+			container = nil
+		} else {
+			return &RecoverableError{err, false}
+		}
+	}
+
+	return w.state.UpdateContainer(containerID, container)
+}
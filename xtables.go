@@ -0,0 +1,54 @@
+package dockeripv6nat
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// All supported xtables modes, i.e. which variant of the iptables binaries to use
+const (
+	XtablesAuto   = "auto"
+	XtablesLegacy = "legacy"
+	XtablesNFT    = "nft"
+)
+
+// ResolveXtablesMode validates the given xtables mode, resolving "auto" to the variant used by the docker daemon
+func ResolveXtablesMode(mode string) (string, error) {
+	switch mode {
+	case XtablesLegacy, XtablesNFT:
+		return mode, nil
+	case XtablesAuto:
+		return detectXtablesMode(), nil
+	}
+
+	return "", fmt.Errorf("unknown xtables mode: %s", mode)
+}
+
+func detectXtablesMode() string {
+	// The docker daemon always creates the DOCKER chain in the IPv4 filter table, so check if it's visible using nft.
+
+	ipt, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv4), iptables.Path("iptables-nft"))
+	if err != nil {
+		return XtablesLegacy
+	}
+
+	chains, err := ipt.ListChains(TableFilter)
+	if err != nil || !contains(chains, ChainDocker) {
+		return XtablesLegacy
+	}
+
+	return XtablesNFT
+}
+
+// xtablesBinary returns the binary for the given xtables mode (e.g. ip6tables-nft-restore),
+// falling back to the plain binary (e.g. ip6tables-restore) if the variant is not available
+func xtablesBinary(command, suffix, mode string) string {
+	variant := command + "-" + mode + suffix
+	if _, err := exec.LookPath(variant); err == nil {
+		return variant
+	}
+
+	return command + suffix
+}